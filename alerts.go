@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Alerts: communication faults and diagnostics, each either active or not.
+// The equipment's own fault codes and the service reminders aren't decoded
+// so there are no alerts for them (see checkReminders).
+// Transitions are logged and kept in a short history, and the current state
+// goes out on the websocket ("alerts") and to PREFIX/alert/ID as true/false,
+// with an HA binary_sensor for each.
+type alert struct {
+	ID     string    `json:"id"`
+	Name   string    `json:"name"`
+	Kind   string    `json:"kind"`	// fault or diagnostic
+	Active bool      `json:"active"`
+	Since  time.Time `json:"since"`	// of the last change, or startup
+	Detail string    `json:"detail,omitempty"`
+
+	subsys string	// whose availability the HA entity follows, if any
+}
+
+type alertEvent struct {
+	Time   time.Time `json:"time"`
+	ID     string    `json:"id"`
+	Name   string    `json:"name"`
+	Active bool      `json:"active"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+const alertHistoryLen = 100
+
+var alerts []*alert	// in the order defined
+var alertHistory []alertEvent
+var alertsMutex sync.Mutex
+
+// add an alert, initially inactive; subsys is the part of the system the
+// alert's data comes from, or "" if it doesn't depend on one
+func defineAlert(id, name, kind, subsys string) {
+	alertsMutex.Lock()
+	defer alertsMutex.Unlock()
+
+	alerts = append(alerts, &alert{ID: id, Name: name, Kind: kind, Since: time.Now(), subsys: subsys})
+}
+
+func init() {
+	names := map[string]string{"tstat": "Thermostat", "airhandler": "Air Handler", "heatpump": "Outdoor Unit", "dampers": "Damper Control"}
+	for _, s := range subsystems {
+		defineAlert("comm-"+s.name, "HVAC "+names[s.name]+" Communication Lost", "fault", "")
+	}
+	defineAlert("bus-error", "HVAC Bus Error", "fault", "")
+}
+
+func alertTopic(id string) string {
+	return mqttTopic("alert/" + id)
+}
+
+// raise or clear an alert; detail says why and may change while it is active
+func setAlert(id string, active bool, detail string) {
+	alertsMutex.Lock()
+	defer alertsMutex.Unlock()
+
+	var a *alert
+	for _, al := range alerts {
+		if al.ID == id {
+			a = al
+		}
+	}
+	if a == nil {
+		panic("no alert " + id)
+	}
+
+	if !active {
+		detail = ""
+	}
+	if a.Active == active && a.Detail == detail {
+		return
+	}
+
+	if a.Active != active {
+		a.Since = time.Now()
+		if active {
+			log.Warnf("alert %s raised: %s", id, detail)
+		} else {
+			log.Infof("alert %s cleared", id)
+		}
+
+		alertHistory = append(alertHistory, alertEvent{a.Since, a.ID, a.Name, active, detail})
+		if len(alertHistory) > alertHistoryLen {
+			alertHistory = alertHistory[1:]
+		}
+
+		if cl := mqttClient; cl != nil && cl.IsConnected() {
+			_ = cl.Publish(alertTopic(id), 0, true, fmt.Sprintf("%v", active))
+		}
+	}
+	a.Active = active
+	a.Detail = detail
+
+	wsCache.update("alerts", alertList())
+}
+
+// copy of the current alerts; alertsMutex must be held
+func alertList() []alert {
+	list := make([]alert, len(alerts))
+	for i, a := range alerts {
+		list[i] = *a
+	}
+	return list
+}
+
+func getAlerts() ([]alert, []alertEvent) {
+	alertsMutex.Lock()
+	defer alertsMutex.Unlock()
+
+	return alertList(), append([]alertEvent{}, alertHistory...)
+}
+
+// publish the state of every alert, eg on (re)connect
+func publishAlerts(cl mqtt.Client) {
+	alertsMutex.Lock()
+	defer alertsMutex.Unlock()
+
+	for _, a := range alerts {
+		_ = cl.Publish(alertTopic(a.ID), 0, true, fmt.Sprintf("%v", a.Active))
+	}
+}
+
+type binarySensorDiscovery struct {
+	State_topic       string              `json:"state_topic"`
+	Name              string              `json:"name"`
+	Device_class      string              `json:"device_class"`
+	Payload_on        string              `json:"payload_on"`
+	Payload_off       string              `json:"payload_off"`
+	Unique_id         string              `json:"unique_id"`
+	Availability      []availabilityEntry `json:"availability"`
+	Availability_mode string              `json:"availability_mode"`
+	Device            *discoveryDevice    `json:"device"`
+}
+
+// publish an HA binary_sensor for each alert
+func publishAlertDiscovery(cl mqtt.Client) {
+	alertsMutex.Lock()
+	defer alertsMutex.Unlock()
+
+	for _, a := range alerts {
+		// a communication fault must still show while the part is offline
+		avail := []availabilityEntry{ { availabilityTopic() } }
+		if a.subsys != "" {
+			avail = discoveryAvailability(a.subsys)
+		}
+
+		bd := binarySensorDiscovery{
+			State_topic:       alertTopic(a.ID),
+			Name:              a.Name,
+			Device_class:      "problem",
+			Payload_on:        "true",
+			Payload_off:       "false",
+			Unique_id:         mqttUniqueID("hvac-alert-" + a.ID),
+			Availability:      avail,
+			Availability_mode: "all",
+			Device:            mqttDevice(),
+		}
+		j, err := json.Marshal(&bd)
+		if err == nil {
+			_ = cl.Publish("homeassistant/binary_sensor/infinitive/" + bd.Unique_id + "/config", 0, true, j)
+		}
+	}
+}
+
+// error frames exchanged by other devices; those in answer to our own
+// requests (eg a raw read of a table a device doesn't have) don't count
+var lastBusError atomic.Int64	// unix ms
+
+const busErrorHold = 10 * time.Minute
+
+func noteErrorFrame(frame *InfinityFrame) {
+	if frame.dst == devSAM {
+		return
+	}
+	lastBusError.Store(time.Now().UnixMilli())
+	setAlert("bus-error", true, fmt.Sprintf("error from %04x to %04x: %x", frame.src, frame.dst, frame.data))
+}
+
+// clear the bus error alert once things have been quiet for a while;
+// called from availabilityMonitor
+func checkBusErrors() {
+	if t := lastBusError.Load(); t != 0 && time.Since(time.UnixMilli(t)) >= busErrorHold {
+		setAlert("bus-error", false, "")
+	}
+}
+
+// Service reminders: it's not yet known where the thermostat keeps these,
+// so there are no alerts for them.  The first unknown byte of 3b.06 may be
+// a set of reminder flags; changes to it are logged at debug level so that
+// can be checked against the thermostat.  Called from the poller only.
+var lastUnknown1 = -1
+
+func checkReminders(b uint8) {
+	if lastUnknown1 >= 0 && int(b) != lastUnknown1 {
+		log.Debugf("3b06 unknown byte changed from 0x%02x to 0x%02x", lastUnknown1, b)
+	}
+	lastUnknown1 = int(b)
+}
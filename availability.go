@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTT availability: PREFIX/availability is "online" while infinitive is
+// connected (with a will setting it "offline" if we go away, and a heartbeat
+// to refresh it), and PREFIX/availability/X says whether frames have
+// recently been seen from each part of the system.  The discovery payloads
+// reference both so HA marks entities unavailable when their data is stale.
+func availabilityTopic() string {
+	return mqttTopic("availability")
+}
+
+type subsystem struct {
+	name   string
+	srcMin uint16
+	srcMax uint16
+}
+
+var subsystems = []subsystem{
+	{ "tstat", 0x2000, 0x20ff },
+	{ "airhandler", 0x4000, 0x42ff },
+	{ "heatpump", 0x5000, 0x51ff },
+	{ "dampers", 0x6000, 0x61ff },
+}
+
+// how long a subsystem can be silent before it is marked offline
+var staleTime = 2 * time.Minute
+
+const heartbeatInterval = time.Minute
+
+var lastSeen [4]atomic.Int64		// unix ms of last frame per subsystem
+
+var subsysOnline [4]bool
+var subsysChecked bool		// false until the first check, to avoid a flap at startup
+var subsysMutex sync.Mutex
+
+// called for every valid frame read from the bus
+func noteFrameSource(src uint16) {
+	for i, s := range subsystems {
+		if src >= s.srcMin && src <= s.srcMax {
+			lastSeen[i].Store(time.Now().UnixMilli())
+			return
+		}
+	}
+}
+
+// when a frame was last seen from the named subsystem, zero if never
+func subsystemLastSeen(name string) time.Time {
+	for i, s := range subsystems {
+		if s.name == name && lastSeen[i].Load() != 0 {
+			return time.UnixMilli(lastSeen[i].Load())
+		}
+	}
+	return time.Time{}
+}
+
+func subsystemTopic(name string) string {
+	return availabilityTopic() + "/" + name
+}
+
+func availabilityString(online bool) string {
+	if online {
+		return "online"
+	}
+	return "offline"
+}
+
+// publish availability of everything, eg on (re)connect
+func publishAvailability(cl mqtt.Client) {
+	_ = cl.Publish(availabilityTopic(), 0, true, "online")
+
+	subsysMutex.Lock()
+	defer subsysMutex.Unlock()
+	if !subsysChecked {
+		return
+	}
+	for i, s := range subsystems {
+		_ = cl.Publish(subsystemTopic(s.name), 0, true, availabilityString(subsysOnline[i]))
+	}
+}
+
+// watch for subsystems going quiet or coming back, and keep the heartbeat going
+func availabilityMonitor() {
+	lastBeat := time.Now()
+	for {
+		time.Sleep(10 * time.Second)
+
+		cl := mqttClient
+		connected := cl != nil && cl.IsConnected()
+
+		subsysMutex.Lock()
+		for i, s := range subsystems {
+			online := time.Since(time.UnixMilli(lastSeen[i].Load())) < staleTime
+			if online != subsysOnline[i] || !subsysChecked {
+				subsysOnline[i] = online
+				log.Infof("%s is now %s", s.name, availabilityString(online))
+				// parts never seen are just not there
+				if lastSeen[i].Load() != 0 {
+					setAlert("comm-"+s.name, !online, fmt.Sprintf("no frames from %s for %v", s.name, staleTime))
+				}
+				if connected {
+					_ = cl.Publish(subsystemTopic(s.name), 0, true, availabilityString(online))
+				}
+			}
+		}
+		subsysChecked = true
+		subsysMutex.Unlock()
+
+		checkBusErrors()
+
+		if connected && time.Since(lastBeat) >= heartbeatInterval {
+			_ = cl.Publish(availabilityTopic(), 0, true, "online")
+			lastBeat = time.Now()
+		}
+	}
+}
+
+// the subsystem whose data a published topic comes from
+func topicSubsystem(topic string) string {
+	switch topic[strings.LastIndex(topic, "/")+1:] {
+	case "blowerRPM", "airflowCFM", "staticPressure", "heatStage", "elecHeat", "action":
+		return "airhandler"
+	case "coolStage", "coilTemp", "outsideTemp":
+		return "heatpump"
+	case "damperPos", "flowWeight":
+		return "dampers"
+	default:
+		return "tstat"
+	}
+}
+
+type availabilityEntry struct {
+	Topic string `json:"topic"`
+}
+
+// the availability list for a discovery payload for data from subsystem
+func discoveryAvailability(subsys string) []availabilityEntry {
+	return []availabilityEntry{ { availabilityTopic() }, { subsystemTopic(subsys) } }
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Bus statistics: protocolStats counts from startup; a sample of the counts
+// is kept every statsInterval for the last hour, so the activity over the
+// last 1, 15 or 60 minutes is the difference between now and a sample.
+
+// a copy of the counters, or the difference between two copies
+type statsCounts struct {
+	Seconds       float64 `json:"seconds"`		// time covered
+	Receives      int64   `json:"receives"`
+	FramingErrors int64   `json:"framingErrors"`
+	Frames        int64   `json:"frames"`
+	FramesToUs    int64   `json:"framesToUs"`
+	FramesToOthers int64  `json:"framesToOthers"`
+	FramesSnooped int64   `json:"framesSnooped"`
+	AcksSent      int64   `json:"acksSent"`
+	Reads         int64   `json:"reads"`
+	TableReads    int64   `json:"tableReads"`
+	Writes        int64   `json:"writes"`
+	Requests      int64   `json:"requests"`
+	Retries       int64   `json:"retries"`
+	Unexpected    int64   `json:"unexpected"`
+	OkFirstTry    int64   `json:"okFirstTry"`
+	OkRetried     int64   `json:"okRetried"`
+	OkMs          int64   `json:"okMs"`
+	Failed        int64   `json:"failed"`
+	FailedMs      int64   `json:"failedMs"`
+	AvgOkMs       int64   `json:"avgOkMs"`
+	AvgFailedMs   int64   `json:"avgFailedMs"`
+}
+
+func (s *protocolStats) snapshot() statsCounts {
+	return statsCounts{
+		Receives:       s.rcvs.Load(),
+		FramingErrors:  s.frerrs.Load(),
+		Frames:         s.frames.Load(),
+		FramesToUs:     s.fself.Load(),
+		FramesToOthers: s.fother.Load(),
+		FramesSnooped:  s.fsnoop.Load(),
+		AcksSent:       s.sresp.Load(),
+		Reads:          s.srd.Load(),
+		TableReads:     s.srdt.Load(),
+		Writes:         s.swr.Load(),
+		Requests:       s.aact.Load(),
+		Retries:        s.aretr.Load(),
+		Unexpected:     s.aother.Load(),
+		OkFirstTry:     s.aok1.Load(),
+		OkRetried:      s.aokN.Load(),
+		OkMs:           s.aokms.Load(),
+		Failed:         s.afail.Load(),
+		FailedMs:       s.afailms.Load(),
+	}
+}
+
+// the counts from o to c over the given time, with averages filled in
+func (c statsCounts) since(o statsCounts, d time.Duration) statsCounts {
+	r := statsCounts{
+		Seconds:        d.Seconds(),
+		Receives:       c.Receives - o.Receives,
+		FramingErrors:  c.FramingErrors - o.FramingErrors,
+		Frames:         c.Frames - o.Frames,
+		FramesToUs:     c.FramesToUs - o.FramesToUs,
+		FramesToOthers: c.FramesToOthers - o.FramesToOthers,
+		FramesSnooped:  c.FramesSnooped - o.FramesSnooped,
+		AcksSent:       c.AcksSent - o.AcksSent,
+		Reads:          c.Reads - o.Reads,
+		TableReads:     c.TableReads - o.TableReads,
+		Writes:         c.Writes - o.Writes,
+		Requests:       c.Requests - o.Requests,
+		Retries:        c.Retries - o.Retries,
+		Unexpected:     c.Unexpected - o.Unexpected,
+		OkFirstTry:     c.OkFirstTry - o.OkFirstTry,
+		OkRetried:      c.OkRetried - o.OkRetried,
+		OkMs:           c.OkMs - o.OkMs,
+		Failed:         c.Failed - o.Failed,
+		FailedMs:       c.FailedMs - o.FailedMs,
+	}
+
+	if ok := r.OkFirstTry + r.OkRetried; ok > 0 {
+		r.AvgOkMs = r.OkMs / ok
+	}
+	if r.Failed > 0 {
+		r.AvgFailedMs = r.FailedMs / r.Failed
+	}
+	return r
+}
+
+type statsSample struct {
+	t      time.Time
+	counts statsCounts
+}
+
+const statsInterval = 15 * time.Second
+
+var statsStart = statsSample{t: time.Now()}	// all zero
+var statsSamples []statsSample			// oldest first, up to an hour's worth
+var statsMutex sync.Mutex
+
+type busStats struct {
+	Since  time.Time   `json:"since"`
+	Total  statsCounts `json:"total"`
+	Last1  statsCounts `json:"last1m"`
+	Last15 statsCounts `json:"last15m"`
+	Last60 statsCounts `json:"last1h"`
+}
+
+// the counts now less those of the sample nearest to d ago, or those at
+// startup if we haven't been running that long; statsMutex must be held
+func statsWindow(now statsSample, d time.Duration) statsCounts {
+	from := statsStart
+	if now.t.Sub(from.t) > d + statsInterval/2 {
+		for _, s := range statsSamples {
+			if now.t.Sub(s.t) <= d + statsInterval/2 {
+				from = s
+				break
+			}
+		}
+	}
+	return now.counts.since(from.counts, now.t.Sub(from.t))
+}
+
+func getBusStats() *busStats {
+	now := statsSample{time.Now(), infinity.stats.snapshot()}
+
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+
+	return &busStats{
+		Since:  statsStart.t,
+		Total:  now.counts.since(statsStart.counts, now.t.Sub(statsStart.t)),
+		Last1:  statsWindow(now, time.Minute),
+		Last15: statsWindow(now, 15 * time.Minute),
+		Last60: statsWindow(now, time.Hour),
+	}
+}
+
+func statsPoller() {
+	last := statsStart
+	for {
+		time.Sleep(statsInterval)
+
+		s := statsSample{time.Now(), infinity.stats.snapshot()}
+		statsMutex.Lock()
+		statsSamples = append(statsSamples, s)
+		for len(statsSamples) > 0 && s.t.Sub(statsSamples[0].t) > time.Hour + statsInterval {
+			statsSamples = statsSamples[1:]
+		}
+		statsMutex.Unlock()
+
+		// the activity since the last line, as always logged
+		log.Info("#STATS# ", fmt.Sprintf("%+v", s.counts.since(last.counts, s.t.Sub(last.t))))
+		last = s
+
+		wsCache.update("busstats", getBusStats())
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"reflect"
+	"strings"
 	"sync"
 )
 
@@ -9,10 +10,11 @@ type cacheMapType map[string]interface{}
 type Cache struct {
 	cacheMap cacheMapType
 	cacheMutex sync.Mutex
+	record bool	// keep a history of changes, see history.go
 }
 
 var wsCache Cache = Cache{ cacheMap: make(cacheMapType) }
-var mqttCache Cache = Cache{ cacheMap: make(cacheMapType) }
+var mqttCache Cache = Cache{ cacheMap: make(cacheMapType), record: true }
 
 func (c *Cache) update(name string, data interface{}) {
 	c.cacheMutex.Lock()
@@ -22,6 +24,9 @@ func (c *Cache) update(name string, data interface{}) {
 	if !reflect.DeepEqual(old, data) {
 		Dispatcher.broadcastEvent(name, data)
 		c.cacheMap[name] = data
+		if c.record {
+			recordHistory(strings.TrimPrefix(name, "mqtt/"), data)
+		}
 	}
 }
 
@@ -32,6 +37,16 @@ func (c *Cache) get(name string) interface{} {
 	return c.cacheMap[name]
 }
 
+// send the cached value again even though it hasn't changed
+func (c *Cache) refresh(name string) {
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+
+	if data, ok := c.cacheMap[name]; ok {
+		Dispatcher.broadcastEvent(name, data)
+	}
+}
+
 func (c *Cache) clear() {
 	c.cacheMutex.Lock()
 	defer c.cacheMutex.Unlock()
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Table fields are described declaratively by their infinity struct tags so
+// they can be decoded to and encoded from API values generically, eg
+//	ZHeatSetpoint [8]uint8 `infinity:"name=heatSetpoint,units=temp,min=40,max=90,writable"`
+// The tag keys are:
+//	field=N		number of the field in the write flags (see fieldFlags)
+//	name=X		API name of the field; fields without one are left alone
+//	units=temp	a whole degree F temperature, shown in the display units
+//	scale=N		the raw value is N times the real one, eg 16 for 1/16 degrees
+//	enum=X		raw values are mapped to and from strings by tableEnums[X]
+//	bool		zero or one, shown as false or true
+//	bits		a bit mask with one bit per zone, each shown as a bool
+//	min=N,max=N	range of raw values a write may set
+//	writable	the field may be written
+// A field that is an [8] array holds a value for each zone and is decoded or
+// encoded for one zone at a time; an [8] array of structs holds a struct of
+// tagged fields for each zone.
+
+type tableEnum struct {
+	toString   func(uint64) string
+	fromString func(string) (uint8, bool)	// nil if it can't be written
+}
+
+var tableEnums = map[string]tableEnum{
+	"fanMode":    { func(v uint64) string { return rawFanModeToString(uint8(v)) }, stringFanModeToRaw },
+	"mode":       { func(v uint64) string { return rawModeToString(uint8(v) & 0xf) }, stringModeToRaw },
+	"tempUnits":  { func(v uint64) string { return rawTempUnitsToString(uint8(v)) }, stringTempUnitsToRaw },
+	"sensorType": { func(v uint64) string { return rawSensorTypeToString(uint16(v)) }, nil },
+}
+
+type fieldSpec struct {
+	index    int	// of the struct field
+	num      int	// field number for the write flags
+	name     string
+	temp     bool
+	scale    float64
+	enum     string
+	isBool   bool
+	bits     bool
+	min      float64
+	max      float64
+	writable bool
+}
+
+var tableSpecs sync.Map	// reflect.Type -> []fieldSpec
+
+// the field specs of a table type, from its tags
+func tableSpec(t reflect.Type) []fieldSpec {
+	if specs, ok := tableSpecs.Load(t); ok {
+		return specs.([]fieldSpec)
+	}
+
+	nums := tableFieldNumbers(t)
+	specs := make([]fieldSpec, t.NumField())
+	for i := range specs {
+		sf := t.Field(i)
+		fs := fieldSpec{index: i, num: nums[i], scale: 1, min: math.Inf(-1), max: math.Inf(1)}
+		fs.name, _ = tagValue(sf, "name")
+		units, _ := tagValue(sf, "units")
+		fs.temp = units == "temp"
+		fs.enum, _ = tagValue(sf, "enum")
+		_, fs.isBool = tagValue(sf, "bool")
+		_, fs.bits = tagValue(sf, "bits")
+		_, fs.writable = tagValue(sf, "writable")
+
+		var err error
+		for _, kv := range []struct{key string; v *float64}{{"scale", &fs.scale}, {"min", &fs.min}, {"max", &fs.max}} {
+			if s, ok := tagValue(sf, kv.key); ok && err == nil {
+				*kv.v, err = strconv.ParseFloat(s, 64)
+			}
+		}
+		if _, ok := tableEnums[fs.enum]; err != nil || (fs.enum != "" && !ok) || (fs.writable && fs.num > 15) {
+			panic(fmt.Sprintf("bad infinity tag on %s.%s", t.Name(), sf.Name))
+		}
+
+		specs[i] = fs
+	}
+
+	tableSpecs.Store(t, specs)
+	return specs
+}
+
+// zone zi's element of a per-zone field, or the field itself
+func zoneElem(f reflect.Value, fs *fieldSpec, zi int) reflect.Value {
+	if f.Kind() == reflect.Array && f.Len() == 8 && (fs.name != "" || f.Type().Elem().Kind() == reflect.Struct) {
+		return f.Index(zi)
+	}
+	return f
+}
+
+func rawValue(f reflect.Value) float64 {
+	switch f.Kind() {
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(f.Int())
+	default:
+		return float64(f.Uint())
+	}
+}
+
+// the API value of a raw field value
+func (fs *fieldSpec) decode(f reflect.Value, zi int) interface{} {
+	switch {
+	case fs.bits:
+		return f.Uint() & (1 << zi) != 0
+	case fs.isBool:
+		return f.Uint() != 0
+	case fs.enum != "":
+		return tableEnums[fs.enum].toString(f.Uint())
+	case f.Kind() == reflect.Array:
+		b := make([]byte, f.Len())
+		reflect.Copy(reflect.ValueOf(b), f)
+		return string(bytes.Trim(b, " \000"))
+	case fs.temp:
+		return displayTemp(float32(rawValue(f) / fs.scale))
+	case fs.scale != 1:
+		return float32(rawValue(f) / fs.scale)
+	default:
+		return f.Interface()
+	}
+}
+
+// the named fields of a table for zone zi, as API values
+func decodeFields(table interface{}, zi int) map[string]interface{} {
+	values := map[string]interface{}{}
+	decodeInto(values, reflect.Indirect(reflect.ValueOf(table)), zi)
+	return values
+}
+
+func decodeInto(values map[string]interface{}, v reflect.Value, zi int) {
+	specs := tableSpec(v.Type())
+	for i := range specs {
+		fs := &specs[i]
+		f := zoneElem(v.Field(fs.index), fs, zi)
+		if f.Kind() == reflect.Struct {
+			decodeInto(values, f, zi)
+		} else if fs.name != "" {
+			values[fs.name] = fs.decode(f, zi)
+		}
+	}
+}
+
+// find the spec of a named field
+func namedField(t reflect.Type, name string) *fieldSpec {
+	specs := tableSpec(t)
+	for i := range specs {
+		if specs[i].name == name {
+			return &specs[i]
+		}
+	}
+	return nil
+}
+
+// whether a table (or pointer to one) has a writable field of this name
+func writableField(table interface{}, name string) bool {
+	fs := namedField(reflect.Indirect(reflect.ValueOf(table)).Type(), name)
+	return fs != nil && fs.writable
+}
+
+// parse a bool from a JSON value or a string
+func boolValue(value interface{}) (bool, bool) {
+	switch v := value.(type) {
+	case bool:
+		return v, true
+	case string:
+		b, err := strconv.ParseBool(v)
+		return b, err == nil
+	}
+	return false, false
+}
+
+// parse a number from a JSON value or a string
+func numberValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// the range of a field in display units, for error messages
+func (fs *fieldSpec) rangeString() string {
+	if fs.temp {
+		return fmt.Sprintf("%v-%v", displayTemp(float32(fs.min / fs.scale)), displayTemp(float32(fs.max / fs.scale)))
+	}
+	return fmt.Sprintf("%v-%v", fs.min / fs.scale, fs.max / fs.scale)
+}
+
+// set a named field of a table for zone zi from an API value, which may be
+// a string (as from MQTT) or a JSON value; returns the write flags for it
+func encodeField(table interface{}, zi int, name string, value interface{}) (uint16, error) {
+	v := reflect.ValueOf(table).Elem()
+	fs := namedField(v.Type(), name)
+	if fs == nil {
+		return 0, fmt.Errorf("unknown setting '%s'", name)
+	}
+	if !fs.writable {
+		return 0, fmt.Errorf("%s is read-only", name)
+	}
+	f := zoneElem(v.Field(fs.index), fs, zi)
+
+	var raw float64
+	switch {
+	case fs.bits, fs.isBool:
+		b, ok := boolValue(value)
+		if !ok {
+			return 0, fmt.Errorf("invalid %s value '%v'", name, value)
+		}
+		if b {
+			raw = 1
+		}
+		if fs.bits {
+			raw = float64(f.Uint() &^ (1 << zi) | uint64(raw) << zi)
+		}
+	case fs.enum != "":
+		s, _ := value.(string)
+		e, ok := uint8(0), false
+		if fromString := tableEnums[fs.enum].fromString; fromString != nil {
+			e, ok = fromString(s)
+		}
+		if !ok {
+			return 0, fmt.Errorf("invalid %s value '%v'", name, value)
+		}
+		raw = float64(e)
+	default:
+		n, ok := numberValue(value)
+		if !ok {
+			return 0, fmt.Errorf("invalid %s value '%v'", name, value)
+		}
+		if fs.temp {
+			raw = float64(rawTemp(float32(n))) * fs.scale
+		} else {
+			raw = math.Round(n * fs.scale)
+		}
+		if raw < fs.min || raw > fs.max {
+			return 0, fmt.Errorf("%s must be %s", name, fs.rangeString())
+		}
+	}
+
+	switch f.Kind() {
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if f.OverflowInt(int64(raw)) {
+			return 0, fmt.Errorf("%s value '%v' out of range", name, value)
+		}
+		f.SetInt(int64(raw))
+	default:
+		if raw < 0 || f.OverflowUint(uint64(raw)) {
+			return 0, fmt.Errorf("%s value '%v' out of range", name, value)
+		}
+		f.SetUint(uint64(raw))
+	}
+
+	return 1 << fs.num, nil
+}
+
+// set several named fields of a table for zone zi; nothing is written if
+// any of them is invalid, so the table can be discarded on error
+func encodeFields(table interface{}, zi int, values map[string]interface{}) (uint16, error) {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	flags := uint16(0)
+	for _, name := range names {
+		fl, err := encodeField(table, zi, name, values[name])
+		if err != nil {
+			return 0, err
+		}
+		flags |= fl
+	}
+	return flags, nil
+}
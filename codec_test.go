@@ -0,0 +1,142 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeFields(t *testing.T) {
+	zone := TStatZoneParams{}
+	zone.ZFanMode[1] = 3
+	zone.ZoneHold = 0x02
+	zone.ZHeatSetpoint[1] = 66
+	zone.ZCoolSetpoint[1] = 78
+	zone.ZTargetHumidity[1] = 40
+	zone.ZOvrdDuration[1] = 90
+	copy(zone.ZName[1][:], "Upstairs    ")
+
+	temps := TStatZoneTemps{}
+	temps.Zones[2] = TStatZoneSensor{Flags: 0x0104, RawTemp: 1085}
+
+	actuals := TStatActuals{OutdoorTemp: -40, RawHumidity: 52}
+
+	tests := []struct {
+		name  string
+		table interface{}
+		zi    int
+		want  map[string]interface{}
+	}{
+		{"zone params", &zone, 1, map[string]interface{}{
+			"fanMode": "high", "hold": true, "heatSetpoint": float32(66), "coolSetpoint": float32(78),
+			"targetHumidity": uint8(40), "overrideDurationMins": uint16(90), "zoneName": "Upstairs"}},
+		{"zone params other zone", &zone, 0, map[string]interface{}{
+			"fanMode": "auto", "hold": false, "heatSetpoint": float32(0), "coolSetpoint": float32(0),
+			"targetHumidity": uint8(0), "overrideDurationMins": uint16(0), "zoneName": ""}},
+		{"zone sensor", &temps, 2, map[string]interface{}{
+			"sensorType": "smartSensor", "currentTempPrecise": float32(67.8125)}},
+		{"signed scaled temp", &actuals, 0, map[string]interface{}{
+			"outdoorTempPrecise": float32(-2.5), "rawHumidity": uint8(52)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := decodeFields(tt.table, tt.zi)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeField(t *testing.T) {
+	tests := []struct {
+		name  string
+		table interface{}
+		zi    int
+		field string
+		value interface{}
+		flags uint16
+		want  interface{}	// decoded after the write
+		err   bool
+	}{
+		{"setpoint", &TStatZoneParams{}, 1, "heatSetpoint", 68.0, 1 << 2, float32(68), false},
+		{"setpoint from string", &TStatZoneParams{}, 0, "heatSetpoint", "70", 1 << 2, float32(70), false},
+		{"setpoint at min", &TStatZoneParams{}, 0, "heatSetpoint", 40.0, 1 << 2, float32(40), false},
+		{"setpoint below min", &TStatZoneParams{}, 0, "heatSetpoint", 39.0, 0, nil, true},
+		{"setpoint above max", &TStatZoneParams{}, 0, "coolSetpoint", 100.0, 0, nil, true},
+		{"setpoint not a number", &TStatZoneParams{}, 0, "coolSetpoint", "warm", 0, nil, true},
+		{"override", &TStatZoneParams{}, 4, "overrideDurationMins", 90.0, 1 << 7, uint16(90), false},
+		{"override above max", &TStatZoneParams{}, 0, "overrideDurationMins", 1441.0, 0, nil, true},
+		{"enum", &TStatZoneParams{}, 2, "fanMode", "med", 1 << 0, "med", false},
+		{"enum unknown value", &TStatZoneParams{}, 0, "fanMode", "turbo", 0, nil, true},
+		{"enum not a string", &TStatZoneParams{}, 0, "fanMode", 1.0, 0, nil, true},
+		{"enum with field number", &TStatCurrentParams{}, 0, "mode", "cool", 1 << 4, "cool", false},
+		{"bit", &TStatZoneParams{}, 3, "hold", true, 1 << 1, true, false},
+		{"bit from string", &TStatZoneParams{}, 3, "hold", "false", 1 << 1, false, false},
+		{"bit bad value", &TStatZoneParams{}, 0, "hold", "maybe", 0, nil, true},
+		{"bool", &TStatSettings{}, 0, "autoMode", true, 1 << 1, true, false},
+		{"no max", &TStatSettings{}, 0, "backlight", 11.0, 0, nil, true},
+		{"read-only", &TStatZoneParams{}, 0, "targetHumidity", 40.0, 0, nil, true},
+		{"unknown", &TStatZoneParams{}, 0, "bogus", 1.0, 0, nil, true},
+		{"overflow", &TStatVacationParams{}, 0, "hours", 70000.0, 0, nil, true},
+		{"negative", &TStatVacationParams{}, 0, "hours", -1.0, 0, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags, err := encodeField(tt.table, tt.zi, tt.field, tt.value)
+			if (err != nil) != tt.err {
+				t.Fatalf("err = %v, want error %v", err, tt.err)
+			}
+			if flags != tt.flags {
+				t.Errorf("flags = 0x%04x, want 0x%04x", flags, tt.flags)
+			}
+			if tt.err {
+				return
+			}
+			if got := decodeFields(tt.table, tt.zi)[tt.field]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decoded %v (%T), want %v (%T)", got, got, tt.want, tt.want)
+			}
+		})
+	}
+}
+
+// only the addressed zone's bit of a per-zone bit mask changes
+func TestEncodeFieldBits(t *testing.T) {
+	zone := TStatZoneParams{ZoneHold: 0x05}
+	if _, err := encodeField(&zone, 1, "hold", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encodeField(&zone, 2, "hold", false); err != nil {
+		t.Fatal(err)
+	}
+	if zone.ZoneHold != 0x03 {
+		t.Errorf("hold bits = 0x%02x, want 0x03", zone.ZoneHold)
+	}
+}
+
+// nothing is flagged if any field is invalid
+func TestEncodeFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		values map[string]interface{}
+		flags  uint16
+		err    bool
+	}{
+		{"several", map[string]interface{}{"heatSetpoint": 65.0, "coolSetpoint": 80.0, "fanMode": "low"}, 0x000d, false},
+		{"one invalid", map[string]interface{}{"heatSetpoint": 65.0, "coolSetpoint": 120.0}, 0, true},
+		{"none", map[string]interface{}{}, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags, err := encodeFields(&TStatZoneParams{}, 0, tt.values)
+			if (err != nil) != tt.err {
+				t.Fatalf("err = %v, want error %v", err, tt.err)
+			}
+			if flags != tt.flags {
+				t.Errorf("flags = 0x%04x, want 0x%04x", flags, tt.flags)
+			}
+		})
+	}
+}
@@ -1,5 +1,10 @@
 package main
 
+import (
+	"math"
+	"sync/atomic"
+)
+
 func rawModeToString(mode uint8) string {
 	switch mode {
 	case 0:
@@ -78,3 +83,87 @@ func rawActionToString(action uint8) string {
 		// on a furnace system perhaps this is furnace only - untested
 	}
 }
+
+// zone sensor kind from the flags in table 3d02; only 0x01 and 0x04 have
+// been seen on a real system so the others are educated guesses
+func rawSensorTypeToString(flags uint16) string {
+	switch flags & 0xff {
+	case 0:
+		return ""
+	case 1:
+		return "thermostat"
+	case 2:
+		return "remoteSensor"
+	case 4:
+		return "smartSensor"
+	default:
+		return "unknown"
+	}
+}
+
+func rawTempUnitsToString(units uint8) string {
+	switch units {
+	case 0:
+		return "F"
+	case 1:
+		return "C"
+	default:
+		return "unknown"
+	}
+}
+
+func stringTempUnitsToRaw(units string) (uint8, bool) {
+	switch units {
+	case "F":
+		return 0, true
+	case "C":
+		return 1, true
+	default:
+		return 0, false
+	}
+}
+
+// Temperatures on the bus are always in degrees F; everything we present is
+// in the units the thermostat is set to, unless overridden with -units.
+var tempUnitsOverride string	// "F", "C" or "" to follow the thermostat
+var tempUnitsC atomic.Bool
+
+// set the display units from the thermostat setting (or the override);
+// returns true if they changed
+func setTempUnits(units string) bool {
+	if tempUnitsOverride != "" {
+		units = tempUnitsOverride
+	}
+	if units != "F" && units != "C" {
+		return false
+	}
+	return tempUnitsC.Swap(units == "C") != (units == "C")
+}
+
+func tempUnits() string {
+	if tempUnitsC.Load() {
+		return "C"
+	}
+	return "F"
+}
+
+// unit of measurement string for HA discovery
+func tempUoM() string {
+	return "°" + tempUnits()
+}
+
+// convert a bus temperature to display units; celsius is rounded to 0.1
+func displayTemp(f float32) float32 {
+	if !tempUnitsC.Load() {
+		return f
+	}
+	return float32(math.Round(float64(f-32)*5/9*10) / 10)
+}
+
+// convert a temperature in display units to whole degrees F for the bus
+func rawTemp(t float32) uint8 {
+	if tempUnitsC.Load() {
+		t = t*9/5 + 32
+	}
+	return uint8(math.Max(0, math.Min(255, math.Round(float64(t)))))
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Device inventory: every address that has sent a frame on the bus, with
+// the kind of equipment it is and, for devices that answer a read of table
+// 01.04, their model, serial number and firmware version.
+type busDevice struct {
+	Address         string    `json:"address"`
+	Kind            string    `json:"kind"`
+	FirstSeen       time.Time `json:"firstSeen"`
+	LastSeen        time.Time `json:"lastSeen"`
+	Frames          uint64    `json:"frames"`
+	ModuleName      string    `json:"moduleName,omitempty"`
+	ModelNumber     string    `json:"modelNumber,omitempty"`
+	SerialNumber    string    `json:"serialNumber,omitempty"`
+	FirmwareVersion string    `json:"firmwareVersion,omitempty"`
+
+	addr      uint16
+	probed    bool		// answered the 01.04 read
+	lastProbe time.Time
+	probeFails int
+}
+
+var devices = map[uint16]*busDevice{}
+var devicesMutex sync.Mutex
+
+// how long to wait before reading 01.04 again from a device that didn't
+// answer, and how many times to try
+const probeRetry = 10 * time.Minute
+const probeMaxFails = 3
+
+// the kind of equipment at an address
+func deviceKind(addr uint16) string {
+	if addr == devSAM {
+		return "sam"
+	}
+	for _, s := range subsystems {
+		if addr >= s.srcMin && addr <= s.srcMax {
+			return s.name
+		}
+	}
+	return "unknown"
+}
+
+// called for every valid frame read from the bus
+func noteDevice(src uint16) {
+	now := time.Now()
+
+	devicesMutex.Lock()
+	defer devicesMutex.Unlock()
+
+	d := devices[src]
+	if d == nil {
+		d = &busDevice{Address: fmt.Sprintf("%04x", src), Kind: deviceKind(src), FirstSeen: now, addr: src}
+		devices[src] = d
+		log.Infof("found %s device at %04x", d.Kind, src)
+	}
+	d.LastSeen = now
+	d.Frames++
+}
+
+// a copy of the inventory, in address order
+func getDevices() []busDevice {
+	devicesMutex.Lock()
+	defer devicesMutex.Unlock()
+
+	list := make([]busDevice, 0, len(devices))
+	for _, d := range devices {
+		list = append(list, *d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].addr < list[j].addr })
+	return list
+}
+
+// a copy of one device's entry, or nil if it hasn't been seen
+func getDevice(addr uint16) *busDevice {
+	devicesMutex.Lock()
+	defer devicesMutex.Unlock()
+
+	if d, ok := devices[addr]; ok {
+		dc := *d
+		return &dc
+	}
+	return nil
+}
+
+// whether the air handler is a fan coil, whose heat can only be electric,
+// rather than a furnace; false until it has been identified.  Only a
+// module name of FURNACE has been seen (from the simulator) so anything
+// else is taken to be a fan coil
+func airHandlerFanCoil() bool {
+	devicesMutex.Lock()
+	defer devicesMutex.Unlock()
+
+	for _, d := range devices {
+		if d.Kind == "airhandler" && d.probed {
+			return !strings.Contains(d.ModuleName, "FURNACE")
+		}
+	}
+	return false
+}
+
+// identify each device as it is found, trying again now and then for
+// those that don't answer
+func deviceProber() {
+	for {
+		time.Sleep(15 * time.Second)
+
+		for _, addr := range devicesToProbe() {
+			probeDevice(addr)
+		}
+	}
+}
+
+func devicesToProbe() []uint16 {
+	devicesMutex.Lock()
+	defer devicesMutex.Unlock()
+
+	addrs := []uint16{}
+	for addr, d := range devices {
+		// we are the SAM, or another one is there which we shouldn't poke
+		if !d.probed && addr != devSAM && d.probeFails < probeMaxFails && time.Since(d.lastProbe) >= probeRetry {
+			d.lastProbe = time.Now()
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+	return addrs
+}
+
+func probeDevice(addr uint16) {
+	info := DeviceInfo{}
+	raw := InfinityProtocolRawRequest{&[]byte{}}
+	if !infinity.Probe(addr, info.addr(), raw) {
+		devicesMutex.Lock()
+		d := devices[addr]
+		d.probeFails++
+		if d.probeFails >= probeMaxFails {
+			log.Infof("no answer from %04x to device info read, giving up", addr)
+		} else {
+			log.Debugf("no answer from %04x to device info read", addr)
+		}
+		devicesMutex.Unlock()
+		return
+	}
+
+	// fields missing from a short answer are left empty
+	buf := make([]byte, binary.Size(info))
+	copy(buf, *raw.data)
+	binary.Read(bytes.NewReader(buf), binary.BigEndian, &info)
+	fields := decodeFields(&info, 0)
+
+	devicesMutex.Lock()
+	d := devices[addr]
+	d.ModuleName = fields["moduleName"].(string)
+	d.ModelNumber = fields["modelNumber"].(string)
+	d.SerialNumber = fields["serialNumber"].(string)
+	d.FirmwareVersion = fields["firmwareVersion"].(string)
+	d.probed = true
+	devicesMutex.Unlock()
+
+	log.Infof("device %04x is %s model %s serial %s firmware %s", addr,
+		fields["moduleName"], fields["modelNumber"], fields["serialNumber"], fields["firmwareVersion"])
+
+	// the thermostat's details go in the HA device block
+	if addr == devTSTAT && mqttClient != nil && mqttClient.IsConnected() {
+		mqttPublishDiscovery(mqttClient)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Diagnostics: rules that look for signs of trouble in the data snooped
+// and polled from the bus, each raising an alert (diag-ID, see alerts.go)
+// when its condition has held for holdMins minutes and clearing it when it
+// has been gone as long.  A rule that can't tell, eg the static pressure
+// rule while the blower is off, leaves its alert as it is.  The rules'
+// parameters can be changed, or rules turned off, with -diag FILE.
+
+type diagRule struct {
+	ID      string             `json:"id"`
+	Name    string             `json:"name"`
+	Enabled bool               `json:"enabled"`
+	Params  map[string]float64 `json:"params"`
+	Active  bool               `json:"active"`
+
+	subsys  string
+	// whether the condition holds, whether that can be told, and why
+	check   func(r *diagRule, d *diagData) (bad bool, known bool, detail string)
+	since   time.Time	// when the condition last changed
+	bad     bool
+}
+
+// what the rules look at, taken fresh for each check
+type diagData struct {
+	now    time.Time
+	values cacheMapType		// mqttCache, without the mqtt/ prefix
+	runs   map[string]time.Time	// stages running now, and since when
+	perF   float64			// display degrees per degree F
+}
+
+func (d *diagData) number(key string) (float64, bool) {
+	return metricValue(d.values[key])
+}
+
+func (d *diagData) text(key string) string {
+	s, _ := d.values[key].(string)
+	return s
+}
+
+// a call for heat or cooling that has ended, for the short cycle rule; a
+// change of stage within a call doesn't end it
+type callRun struct {
+	start, end time.Time
+}
+
+var diagCalls = map[string]time.Time{}	// heat or cool, running since
+var diagRuns []callRun			// the last day's
+var diagMutex sync.Mutex
+
+var diagRules = []*diagRule{
+	{
+		ID: "short-cycle", Name: "HVAC Short Cycling", subsys: "airhandler",
+		Params: map[string]float64{"holdMins": 0, "minRunMins": 5, "maxShort": 3, "windowMins": 60},
+		check: func(r *diagRule, d *diagData) (bool, bool, string) {
+			n := 0
+			for _, run := range diagRuns {
+				if d.now.Sub(run.end) <= minutes(r.Params["windowMins"]) && run.end.Sub(run.start) < minutes(r.Params["minRunMins"]) {
+					n++
+				}
+			}
+			return float64(n) >= r.Params["maxShort"], true,
+				fmt.Sprintf("%d heating or cooling runs shorter than %g minutes in the last %g minutes", n, r.Params["minRunMins"], r.Params["windowMins"])
+		},
+	},
+	{
+		ID: "static-pressure", Name: "HVAC Static Pressure Out Of Range", subsys: "airhandler",
+		Params: map[string]float64{"holdMins": 5, "min": 0.05, "max": 1.0},
+		check: func(r *diagRule, d *diagData) (bool, bool, string) {
+			rpm, ok1 := d.number("blowerRPM")
+			sp, ok2 := d.number("staticPressure")
+			if !ok1 || !ok2 || rpm == 0 {
+				return false, false, ""
+			}
+			return sp < r.Params["min"] || sp > r.Params["max"], true,
+				fmt.Sprintf("static pressure %.2f in. wc, expected %g-%g", sp, r.Params["min"], r.Params["max"])
+		},
+	},
+	{
+		// the coil temp drops below the outside temperature once the
+		// compressor is cooling (see the 3e01 decode in infinitive.go)
+		ID: "coil-temp", Name: "HVAC Coil Temperature Not Dropping", subsys: "heatpump",
+		Params: map[string]float64{"holdMins": 10, "minDeltaF": 5},
+		check: func(r *diagRule, d *diagData) (bool, bool, string) {
+			coil, ok1 := d.number("coilTemp")
+			outside, ok2 := d.number("outsideTemp")
+			if !ok1 || !ok2 || d.text("action") != "cooling" {
+				return false, false, ""
+			}
+			return coil > outside - r.Params["minDeltaF"] * d.perF, true,
+				fmt.Sprintf("coil %g, outside %g while cooling", coil, outside)
+		},
+	},
+	{
+		ID: "stuck-stage", Name: "HVAC Stage Stuck On", subsys: "airhandler",
+		Params: map[string]float64{"holdMins": 0, "maxRunMins": 480},
+		check: func(r *diagRule, d *diagData) (bool, bool, string) {
+			stuck := []string{}
+			for id, start := range d.runs {
+				if (strings.HasPrefix(id, "heat") || strings.HasPrefix(id, "cool")) && d.now.Sub(start) > minutes(r.Params["maxRunMins"]) {
+					stuck = append(stuck, fmt.Sprintf("%s on for %v", id, d.now.Sub(start).Round(time.Minute)))
+				}
+			}
+			sort.Strings(stuck)
+			return len(stuck) > 0, true, strings.Join(stuck, ", ")
+		},
+	},
+	{
+		ID: "setpoint", Name: "HVAC Zone Not Reaching Setpoint", subsys: "tstat",
+		Params: map[string]float64{"holdMins": 180, "toleranceF": 2},
+		check: func(r *diagRule, d *diagData) (bool, bool, string) {
+			mode := d.text("mode")
+			heat := mode == "heat" || mode == "auto" || mode == "electric" || mode == "heatpump"
+			cool := mode == "cool" || mode == "auto"
+			if !heat && !cool {
+				return false, false, ""
+			}
+
+			tol := r.Params["toleranceF"] * d.perF
+			far := []string{}
+			for zn := 1; zn <= 8; zn++ {
+				zp := fmt.Sprintf("zone/%d/", zn)
+				t, ok := d.number(zp+"currentTemp")
+				if !ok {
+					continue
+				}
+				if hs, ok := d.number(zp+"heatSetpoint"); ok && heat && t < hs - tol {
+					far = append(far, fmt.Sprintf("zone %d at %g, heating to %g", zn, t, hs))
+				}
+				if cs, ok := d.number(zp+"coolSetpoint"); ok && cool && t > cs + tol {
+					far = append(far, fmt.Sprintf("zone %d at %g, cooling to %g", zn, t, cs))
+				}
+			}
+			return len(far) > 0, true, strings.Join(far, ", ")
+		},
+	},
+}
+
+func minutes(m float64) time.Duration {
+	return time.Duration(m * float64(time.Minute))
+}
+
+func init() {
+	for _, r := range diagRules {
+		r.Enabled = true
+		defineAlert("diag-"+r.ID, r.Name, "diagnostic", r.subsys)
+	}
+}
+
+// the settings in a -diag file, by rule ID, eg
+//	{ "static-pressure": { "params": { "max": 0.8 } }, "coil-temp": { "enabled": false } }
+type diagSetting struct {
+	Enabled *bool              `json:"enabled"`
+	Params  map[string]float64 `json:"params"`
+}
+
+func loadDiagnostics(file string) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var settings map[string]diagSetting
+	if err := json.Unmarshal(b, &settings); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+
+	diagMutex.Lock()
+	defer diagMutex.Unlock()
+
+	for id, s := range settings {
+		var rule *diagRule
+		for _, r := range diagRules {
+			if r.ID == id {
+				rule = r
+			}
+		}
+		if rule == nil {
+			return fmt.Errorf("%s: no rule '%s'", file, id)
+		}
+
+		if s.Enabled != nil {
+			rule.Enabled = *s.Enabled
+		}
+		for p, v := range s.Params {
+			if _, ok := rule.Params[p]; !ok {
+				return fmt.Errorf("%s: rule %s has no parameter '%s'", file, id, p)
+			}
+			rule.Params[p] = v
+		}
+	}
+	return nil
+}
+
+// called with the stages running whenever they may have changed
+func noteCalls(active map[string]bool, now time.Time) {
+	diagMutex.Lock()
+	defer diagMutex.Unlock()
+
+	for _, call := range []string{"heat", "cool"} {
+		on := false
+		for id := range active {
+			if strings.HasPrefix(id, call) {
+				on = true
+			}
+		}
+
+		start, running := diagCalls[call]
+		if on && !running {
+			diagCalls[call] = now
+		} else if !on && running {
+			delete(diagCalls, call)
+			diagRuns = append(diagRuns, callRun{start, now})
+		}
+	}
+
+	for len(diagRuns) > 0 && now.Sub(diagRuns[0].end) > 24 * time.Hour {
+		diagRuns = diagRuns[1:]
+	}
+}
+
+func getDiagnostics() []diagRule {
+	diagMutex.Lock()
+	defer diagMutex.Unlock()
+
+	list := []diagRule{}
+	for _, r := range diagRules {
+		c := *r
+		c.Params = map[string]float64{}
+		for p, v := range r.Params {
+			c.Params[p] = v
+		}
+		list = append(list, c)
+	}
+	return list
+}
+
+func checkDiagnostics() {
+	d := &diagData{now: time.Now(), values: cacheMapType{}, runs: runningStages(), perF: 1}
+	for k, v := range mqttCache.dump() {
+		d.values[strings.TrimPrefix(k, "mqtt/")] = v
+	}
+	if tempUnits() == "C" {
+		d.perF = 5.0 / 9
+	}
+
+	diagMutex.Lock()
+	defer diagMutex.Unlock()
+
+	for _, r := range diagRules {
+		if !r.Enabled {
+			if r.Active {
+				r.Active = false
+				setAlert("diag-"+r.ID, false, "")
+			}
+			continue
+		}
+
+		// leave things be while the part the data comes from is quiet
+		if d.now.Sub(subsystemLastSeen(r.subsys)) >= staleTime {
+			continue
+		}
+
+		bad, known, detail := r.check(r, d)
+		if !known {
+			r.since = time.Time{}
+			continue
+		}
+		if r.since.IsZero() || bad != r.bad {
+			r.since = d.now
+			r.bad = bad
+		}
+
+		if bad && (r.Active || d.now.Sub(r.since) >= minutes(r.Params["holdMins"])) {
+			r.Active = true
+			setAlert("diag-"+r.ID, true, detail)
+		} else if !bad && r.Active && d.now.Sub(r.since) >= minutes(r.Params["holdMins"]) {
+			r.Active = false
+			setAlert("diag-"+r.ID, false, "")
+		}
+	}
+}
+
+func diagnosticsMonitor() {
+	for {
+		time.Sleep(30 * time.Second)
+		checkDiagnostics()
+	}
+}
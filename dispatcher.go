@@ -1,7 +1,13 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"os"
+	"sort"
+	"sync"
 	"time"
 	"strings"
 	"encoding/json"
@@ -21,6 +27,78 @@ type discoveryTopic struct {
 	Unique_id   string    `json:"unique_id"`
 }
 
+// a sensor's discovery payload: its topic info plus availability
+type discoveryConfig struct {
+	*discoveryTopic
+	Availability      []availabilityEntry `json:"availability"`
+	Availability_mode string              `json:"availability_mode"`
+	Device            *discoveryDevice    `json:"device"`
+}
+
+// the HA device that all our entities belong to, one per system
+type discoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+	Sw_version   string   `json:"sw_version,omitempty"`
+	Serial_number string  `json:"serial_number,omitempty"`
+}
+
+func mqttDevice() *discoveryDevice {
+	name := "Infinitive HVAC"
+	if mqttSystemID != "" {
+		name += " " + mqttSystemID
+	}
+	dev := &discoveryDevice{
+		Identifiers:  []string{mqttUniqueID("infinitive")},
+		Name:         name,
+		Manufacturer: "Carrier",
+		Model:        "Infinity",
+	}
+
+	// describe the thermostat once it has identified itself
+	if d := getDevice(devTSTAT); d != nil {
+		if d.ModelNumber != "" {
+			dev.Model = d.ModelNumber
+		}
+		dev.Sw_version = d.FirmwareVersion
+		dev.Serial_number = d.SerialNumber
+	}
+	return dev
+}
+
+// discovery config for an MQTT Climate entity, one per zone
+type climateDiscovery struct {
+	Name                    string   `json:"name"`
+	Unique_id               string   `json:"unique_id"`
+	Modes                   []string `json:"modes"`
+	Fan_modes               []string `json:"fan_modes"`
+	Preset_modes            []string `json:"preset_modes"`
+	Current_temperature_topic string `json:"current_temperature_topic"`
+	Current_humidity_topic  string   `json:"current_humidity_topic"`
+	Mode_state_topic        string   `json:"mode_state_topic"`
+	Mode_state_template     string   `json:"mode_state_template"`
+	Mode_command_topic      string   `json:"mode_command_topic"`
+	Action_topic            string   `json:"action_topic"`
+	Fan_mode_state_topic    string   `json:"fan_mode_state_topic"`
+	Fan_mode_command_topic  string   `json:"fan_mode_command_topic"`
+	Preset_mode_state_topic string   `json:"preset_mode_state_topic"`
+	Preset_mode_command_topic string `json:"preset_mode_command_topic"`
+	Temperature_high_state_topic string `json:"temperature_high_state_topic"`
+	Temperature_high_command_topic string `json:"temperature_high_command_topic"`
+	Temperature_low_state_topic string `json:"temperature_low_state_topic"`
+	Temperature_low_command_topic string `json:"temperature_low_command_topic"`
+	Temperature_unit        string   `json:"temperature_unit"`
+	Temp_step               float32  `json:"temp_step"`
+	Precision               float32  `json:"precision"`
+	Min_temp                float32  `json:"min_temp"`
+	Max_temp                float32  `json:"max_temp"`
+	Availability            []availabilityEntry `json:"availability"`
+	Availability_mode       string   `json:"availability_mode"`
+	Device                  *discoveryDevice `json:"device"`
+}
+
 type EventDispatcher struct {
 	listeners  map[*EventListener]bool
 	broadcast  chan []byte
@@ -34,14 +112,28 @@ type MqttEvent struct {
 }
 
 type MqttConn struct {
-	url string	// "tcp://host.com:1883"
+	url string	// "tcp://host.com:1883", "ssl://host.com:8883", "wss://host.com/mqtt"
+	username string	// overridden by any user in the url
 	password string
+	caFile string	// PEM CA certificate(s) to verify the broker with, instead of the system's
+	certFile string	// PEM client certificate and key, for brokers requiring them
+	keyFile string
+	insecure bool	// don't verify the broker's certificate at all
 }
 
 var Dispatcher *EventDispatcher = newEventDispatcher()
 
 var mqttClient mqtt.Client
 
+// prefix for all our topics, and an optional ID for this system that keeps
+// client and discovery IDs distinct when several systems share a broker
+var mqttPrefix = "infinitive"
+var mqttSystemID = ""
+
+// zones currently announced through HA discovery, zone number -> name
+var mqttZones = map[uint8]string{}
+var mqttZonesMutex sync.Mutex
+
 func newEventDispatcher() *EventDispatcher {
 	return &EventDispatcher{
 		broadcast:  make(chan []byte, 64),
@@ -68,7 +160,7 @@ func serializeEvent(source string, data interface{}) []byte {
 func (d *EventDispatcher) broadcastEvent(source string, data interface{}) {
 	if source[0:5] == "mqtt/" {
 		if mqttClient != nil {
-			topic := source[5:]
+			topic := mqttTopic(source[5:])
 			value := fmt.Sprintf("%v", data)
 			log.Infof("MQTT PUB: %s -> %s", topic, value)
 			_ = mqttClient.Publish(topic, 0, true, value)
@@ -101,41 +193,179 @@ func (h *EventDispatcher) run() {
 	}
 }
 
+// full topic name for a topic relative to the prefix
+func mqttTopic(t string) string {
+	return mqttPrefix + "/" + t
+}
+
+// unique ID for HA discovery, qualified by the system ID if there is one
+func mqttUniqueID(id string) string {
+	if mqttSystemID == "" {
+		return id
+	}
+	return id + "-" + mqttSystemID
+}
+
+// result of a command received on a set topic, published on PREFIX/response
+type commandResponse struct {
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+	Status  string `json:"status"`		// "ok" or "error"
+	Reason  string `json:"reason,omitempty"`
+}
+
+// state topics showing what each set topic changes, relative to the
+// prefix, zone/X or vacation
+var mqttSetStates = map[string][]string{
+	"mode": {"mode"},
+
+	"zone/fanMode":              {"fanMode"},
+	"zone/heatSetpoint":         {"heatSetpoint"},
+	"zone/coolSetpoint":         {"coolSetpoint"},
+	"zone/hold":                 {"hold", "preset"},
+	"zone/preset":               {"preset", "hold"},
+	"zone/overrideDuration":     {"overrideDurationMins"},
+	"zone/overrideDurationMins": {"overrideDurationMins"},
+
+	"vacation/active":      {"active", "days", "hours"},
+	"vacation/days":        {"days", "hours", "active"},
+	"vacation/hours":       {"hours", "days", "active"},
+	"vacation/minTemp":     {"minTemp"},
+	"vacation/maxTemp":     {"maxTemp"},
+	"vacation/minHumidity": {"minHumidity"},
+	"vacation/maxHumidity": {"maxHumidity"},
+	"vacation/fanMode":     {"fanMode"},
+}
+
+// the state topics for a set topic split at '/' (without the prefix),
+// nil if it isn't one
+func mqttStateTopics(ts []string) []string {
+	if len(ts) < 2 || ts[len(ts)-1] != "set" {
+		return nil
+	}
+
+	var key, base string
+	switch {
+	case len(ts) == 4 && ts[0] == "zone":
+		key, base = "zone/" + ts[2], "zone/" + ts[1] + "/"
+	case len(ts) == 3 && ts[0] == "vacation":
+		key, base = "vacation/" + ts[1], "vacation/"
+	case len(ts) == 3 && ts[0] == "tstat":
+		// published under the same names they're written by
+		if writableField(TStatSettings{}, ts[1]) {
+			return []string{"tstat/" + ts[1]}
+		}
+		return nil
+	case len(ts) == 2:
+		key = ts[0]
+	default:
+		return nil
+	}
+
+	var topics []string
+	for _, s := range mqttSetStates[key] {
+		topics = append(topics, base + s)
+	}
+	return topics
+}
+
 // handle messages
-// topics: infinitive/SETTING/set (global)
-//	infinitive/zone/X/SETTING/set (zone X)
+// topics: PREFIX/SETTING/set (global)
+//	PREFIX/zone/X/SETTING/set (zone X)
 func  mqttMessageHandler(client mqtt.Client, msg mqtt.Message) {
 	log.Infof("MQTT: Received message: %s from topic: %s", msg.Payload(), msg.Topic())
 
-	ts := strings.Split(msg.Topic(), "/")
+	ts := strings.Split(strings.TrimPrefix(msg.Topic(), mqttPrefix + "/"), "/")
 	ps := fmt.Sprintf("%s", msg.Payload())
 
-	if len(ts) < 3 || ts[0] != "infinitive" || ts[len(ts)-1] != "set" {
-		log.Errorf("mqtt received unexpected topic '%s'", msg.Topic())
-	} else if len(ts) == 5 && ts[1] == "zone" {
+	var err error
+	if len(ts) < 2 || !strings.HasPrefix(msg.Topic(), mqttPrefix + "/") || ts[len(ts)-1] != "set" {
+		err = errors.New("unexpected topic")
+	} else if len(ts) == 4 && ts[0] == "zone" {
 		// zone-based
-		if ps[len(ps)-2:len(ps)-1] == "." {
-			ps = ps[0:len(ps)-2]
-		}
-		_ = putConfig(ts[2], ts[3], ps)
-	} else if len(ts) == 4 && ts[1] == "vacation" {
-		_ = putVacationConfig(ts[2], ps)
-	} else if len(ts) == 3 {
+		err = putConfig(ts[1], ts[2], ps)
+	} else if len(ts) == 3 && ts[0] == "vacation" {
+		err = putVacationConfig(ts[1], ps)
+	} else if len(ts) == 3 && ts[0] == "tstat" {
+		err = putTstatSettings(ts[1], ps)
+	} else if len(ts) == 2 {
 		// global
-		_ = putConfig("0", ts[1], ps)
+		err = putConfig("0", ts[0], ps)
 	} else {
-		log.Errorf("mqtt received malformed topic '%s'", msg.Topic())
+		err = errors.New("malformed topic")
+	}
+
+	res := commandResponse{Topic: msg.Topic(), Payload: ps, Status: "ok"}
+	if err != nil {
+		log.Errorf("mqtt command '%s' on topic '%s' failed: %s", ps, msg.Topic(), err)
+		res.Status = "error"
+		res.Reason = err.Error()
+
+		// republish the values we have so anything showing the requested
+		// value goes back to the actual one
+		for _, t := range mqttStateTopics(ts) {
+			mqttCache.refresh("mqtt/" + t)
+		}
+	}
+
+	j, _ := json.Marshal(&res)
+	_ = client.Publish(mqttTopic("response"), 0, false, j)
+}
+
+// TLS settings for ssl:// and wss:// brokers; nil if the defaults will do
+func (mc *MqttConn) tlsConfig() (*tls.Config, error) {
+	if mc.caFile == "" && mc.certFile == "" && mc.keyFile == "" && !mc.insecure {
+		return nil, nil
+	}
+
+	tc := &tls.Config{InsecureSkipVerify: mc.insecure}
+
+	if mc.caFile != "" {
+		pem, err := os.ReadFile(mc.caFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in '%s'", mc.caFile)
+		}
+	}
+
+	if mc.certFile != "" || mc.keyFile != "" {
+		if mc.certFile == "" || mc.keyFile == "" {
+			return nil, errors.New("client certificate and key must be given together")
+		}
+		cert, err := tls.LoadX509KeyPair(mc.certFile, mc.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
 	}
+
+	return tc, nil
 }
 
 // set up for async connect/reconnect (for robustness across restarts on eithesride) 
-func ConnectMqtt(url string, password string) {
+func ConnectMqtt(mc *MqttConn) error {
+	tc, err := mc.tlsConfig()
+	if err != nil {
+		return err
+	}
 
 	// set mqtt client options
 	co := mqtt.NewClientOptions()
-	co.AddBroker(url)
-	co.SetPassword(password)
-	co.SetClientID("infinitive_mqtt_client")
+	co.AddBroker(mc.url)
+	co.SetUsername(mc.username)
+	co.SetPassword(mc.password)
+	if tc != nil {
+		co.SetTLSConfig(tc)
+	}
+	clientID := "infinitive_mqtt_client"
+	if mqttSystemID != "" {
+		clientID += "_" + mqttSystemID
+	}
+	co.SetClientID(clientID)
+	co.SetWill(availabilityTopic(), "offline", 0, true)
 	co.SetOnConnectHandler(mqttOnConnect)
 	co.SetConnectionLostHandler(func(cl mqtt.Client, err error) {log.Info("MQTT: Connection lost: ", err.Error())})
 	co.SetReconnectingHandler(func(cl mqtt.Client, _ *mqtt.ClientOptions) {log.Info("MQTT: Trying to reconnect")})
@@ -150,67 +380,79 @@ func ConnectMqtt(url string, password string) {
 	// start trying to connect - resolved in callbacks
 	log.Info("MTQQ: Start trying to connect")
 	mqttClient.Connect()
+	return nil
 }
 
 // on connect, subscribe to needed topics
 func mqttOnConnect(cl mqtt.Client) {
 	log.Info("MQTT: Connected, subscribing...")
 
-	// subscribe for zone settings
-	t := cl.Subscribe("infinitive/zone/+/+/set", 0, mqttMessageHandler)
-	t.Wait()
-	if (t.Error() != nil) {
-		log.Error("MQTT: failed to subscribe for infinitive/zone/+/+/set: ", t.Error())
-	} else {
-		log.Info("MQTT: subscribe succeeded for infinitive/zone/+/+/set")
+	// subscribe for zone, vacation, thermostat and global settings
+	for _, st := range []string{"zone/+/+/set", "vacation/+/set", "tstat/+/set", "+/set"} {
+		st = mqttTopic(st)
+		t := cl.Subscribe(st, 0, mqttMessageHandler)
+		t.Wait()
+		if (t.Error() != nil) {
+			log.Error("MQTT: failed to subscribe for " + st + ": ", t.Error())
+		} else {
+			log.Info("MQTT: subscribe succeeded for " + st)
+		}
 	}
 
-	// subscribe for vacation settings
-	t = cl.Subscribe("infinitive/vacation/+/set", 0, mqttMessageHandler)
-	t.Wait()
-	if (t.Error() != nil) {
-		log.Error("MQTT: failed to subscribe for infinitive/vacation/+/set: ", t.Error())
-	} else {
-		log.Info("MQTT: subscribe succeeded for infinitive/vacation/+/set")
+	publishAvailability(cl)
+	publishAlerts(cl)
+	mqttPublishDiscovery(cl)
+
+	// flush the MQTT value cache
+	mqttCache.clear()
+}
+
+// publish HA discovery topics; called on connect and when they change
+func mqttPublishDiscovery(cl mqtt.Client) {
+	tuom := tempUoM()
+	discoveryTopics := []discoveryTopic {
+		{ "outdoorTemp", "HVAC Outdoor Temperature", "temperature", tuom, "hvac-sensors-odt" },
+		{ "outdoorTempPrecise", "HVAC Precise Outdoor Temperature", "temperature", tuom, "hvac-sensors-podt" },
+		{ "rawHumidity", "HVAC Raw Indoor Humidity", "humidity", "%", "hvac-sensors-rawhum" },
+		{ "humidity", "HVAC Indoor Humidity", "humidity", "%", "hvac-sensors-hum" },
+		{ "rawMode", "HVAC Raw Mode", "", "", "hvac-sensors-rawmode" },
+		{ "blowerRPM", "HVAC Blower RPM", "", "RPM", "hvac-sensors-blowerrpm" },
+		{ "airflowCFM", "HVAC Airflow CFM", "", "CFM", "hvac-sensors-aflo" },
+		{ "staticPressure", "HVAC Static Pressure", "distance", "in", "hvac-sensors-ahsp" },
+		{ "coolStage", "HVAC Cool Stage", "", "", "hvac-sensors-acstage" },
+		{ "heatStage", "HVAC Heat Stage", "", "", "hvac-sensors-heatstage" },
+		{ "action", "HVAC Action", "enum", "", "hvac-sensors-actn" },
+
+		{ "vacation/active", "Vacation Mode Active", "enum", "", "hvac-sensors-vacay-active" },  // maybe should be a binary_sensor
+		{ "vacation/days", "Vacation Mode Days Remaining", "duration", "d", "hvac-sensors-vacay-days" },
+		{ "vacation/hours", "Vacation Mode Hours Remaining", "duration", "h", "hvac-sensors-vacay-hours" },
+		{ "vacation/minTemp", "Vacation Mode Minimum Temperature", "temperature", tuom, "hvac-sensors-vacay-mint" },
+		{ "vacation/maxTemp", "Vacation Mode Maximum Temperature", "temperature", tuom, "hvac-sensors-vacay-maxt" },
+		{ "vacation/minHumidity", "Vacation Mode Minimum Humidity", "humidity", "%", "hvac-sensors-vacay-minh" },
+		{ "vacation/maxHumidity", "Vacation Mode Maximum Humidity", "humidity", "%", "hvac-sensors-vacay-maxh" },
+		{ "vacation/fanMode", "Vacation Mode Fan Mode", "enum", "", "hvac-sensors-vacay-fm" },
+
+		{ "tstat/deadband", "Thermostat Deadband", "", "", "hvac-sensors-tstat-deadband" },
+		{ "tstat/cyclesPerHour", "Thermostat Cycles Per Hour", "", "", "hvac-sensors-tstat-cph" },
+		{ "tstat/autoMode", "Thermostat Auto Mode Enabled", "enum", "", "hvac-sensors-tstat-automode" },
+		{ "tstat/backlight", "Thermostat Backlight", "", "", "hvac-sensors-tstat-backlight" },
+		{ "tstat/tempUnits", "Thermostat Temperature Units", "enum", "", "hvac-sensors-tstat-units" },
 	}
 
-	// subscribe for global settings
-	t = cl.Subscribe("infinitive/+/set", 0, mqttMessageHandler)
-	t.Wait()
-	if (t.Error() != nil) {
-		log.Error("MQTT: failed to subscribe for infinitive/+/set: ", t.Error())
-	} else {
-		log.Info("MQTT: subscribe succeeded for infinitive/+/set")
+	mqttZonesMutex.Lock()
+	zones := make(map[uint8]string, len(mqttZones))
+	for zn, name := range mqttZones {
+		zones[zn] = name
 	}
+	mqttZonesMutex.Unlock()
 
-	discoveryTopics := []discoveryTopic {
-		{ "infinitive/outdoorTemp", "HVAC Outdoor Temperature", "temperature", "°F", "hvac-sensors-odt" },
-		{ "infinitive/humidity", "HVAC Indoor Humidity", "humidity", "%", "hvac-sensors-hum" },
-		{ "infinitive/rawMode", "HVAC Raw Mode", "", "", "hvac-sensors-rawmode" },
-		{ "infinitive/blowerRPM", "HVAC Blower RPM", "", "RPM", "hvac-sensors-blowerrpm" },
-		{ "infinitive/airflowCFM", "HVAC Airflow CFM", "", "CFM", "hvac-sensors-aflo" },
-		{ "infinitive/staticPressure", "HVAC Static Pressure", "distance", "in", "hvac-sensors-ahsp" },
-		{ "infinitive/coolStage", "HVAC Cool Stage", "", "", "hvac-sensors-acstage" },
-		{ "infinitive/heatStage", "HVAC Heat Stage", "", "", "hvac-sensors-heatstage" },
-		{ "infinitive/action", "HVAC Action", "enum", "", "hvac-sensors-actn" },
-
-		{ "infinitive/vacation/active", "Vacation Mode Active", "enum", "", "hvac-sensors-vacay-active" },  // maybe should be a binary_sensor
-		{ "infinitive/vacation/days", "Vacation Mode Days Remaining", "duration", "d", "hvac-sensors-vacay-days" },
-		{ "infinitive/vacation/hours", "Vacation Mode Hours Remaining", "duration", "h", "hvac-sensors-vacay-hours" },
-		{ "infinitive/vacation/minTemp", "Vacation Mode Minimum Temperature", "temperature", "°F", "hvac-sensors-vacay-mint" },
-		{ "infinitive/vacation/maxTemp", "Vacation Mode Maximum Temperature", "temperature", "°F", "hvac-sensors-vacay-maxt" },
-		{ "infinitive/vacation/minHumidity", "Vacation Mode Minimum Humidity", "humidity", "%", "hvac-sensors-vacay-minh" },
-		{ "infinitive/vacation/maxHumidity", "Vacation Mode Maximum Humidity", "humidity", "%", "hvac-sensors-vacay-maxh" },
-		{ "infinitive/vacation/fanMode", "Vacation Mode Fan Mode", "enum", "", "hvac-sensors-vacay-fm" },
-
-		// per-zone "bonus" sensors (outside of the Climate platform model)
-		// TODO: these should be parametrized, maybe do along with the Climate entities)
-		{ "infinitive/zone/1/damperPos", "HVAC Zone 1 Damper Postion", "", "%", "hvac-sensors-z1-dpos" },
-		{ "infinitive/zone/2/damperPos", "HVAC Zone 2 Damper Postion", "", "%", "hvac-sensors-z2-dpos" },
-		{ "infinitive/zone/1/flowWeight", "HVAC Zone 1 Airflow Weight", "", "", "hvac-sensors-z1-fwgt" },
-		{ "infinitive/zone/2/flowWeight", "HVAC Zone 2 Airflow Weight", "", "", "hvac-sensors-z2-fwgt" },
-		{ "infinitive/zone/1/overrideDurationMins", "HVAC Zone 1 Override Duration", "duration", "min", "hvac-sensors-z1-odur" },
-		{ "infinitive/zone/2/overrideDurationMins", "HVAC Zone 2 Override Duration", "duration", "min", "hvac-sensors-z2-odur" },
+	for zn, name := range zones {
+		discoveryTopics = append(discoveryTopics, zoneDiscoveryTopics(zn, tuom)...)
+
+		j, err := json.Marshal(zoneClimateDiscovery(zn, name))
+		if err == nil {
+			_ = cl.Publish(zoneClimateConfigTopic(zn), 0, true, j)
+		}
 	}
 
 	// write discovery topics for HA
@@ -221,16 +463,133 @@ func mqttOnConnect(cl mqtt.Client) {
 		"unique_id": "hvac-sensors-heatstage"}`)
 		*/
 	for _, v := range discoveryTopics {
-		log.Errorf("MQTT STR %v", &v)
-		j, err := json.Marshal(&v)
-		log.Errorf("MQTT PUB %v: %s", err, j)
+		log.Debugf("MQTT STR %v", &v)
+		subsys := topicSubsystem(v.Topic)
+		v.Topic = mqttTopic(v.Topic)
+		v.Unique_id = mqttUniqueID(v.Unique_id)
+		dc := discoveryConfig{&v, discoveryAvailability(subsys), "all", mqttDevice()}
+		j, err := json.Marshal(&dc)
+		log.Debugf("MQTT PUB %v: %s", err, j)
 		if err == nil {
 			_ = cl.Publish("homeassistant/sensor/infinitive/" + v.Unique_id + "/config", 0, true, j)
 		}
 	}
 
-	// flush the MQTT value cache
-	mqttCache.clear()
+	publishAlertDiscovery(cl)
+	publishRuntimeDiscovery(cl)
+}
+
+// per-zone "bonus" sensors (outside of the Climate platform model)
+func zoneDiscoveryTopics(zn uint8, tuom string) []discoveryTopic {
+	zp := fmt.Sprintf("zone/%d", zn)
+	zn_s := fmt.Sprintf("HVAC Zone %d", zn)
+	id := fmt.Sprintf("hvac-sensors-z%d", zn)
+
+	return []discoveryTopic {
+		{ zp+"/damperPos", zn_s+" Damper Position", "", "%", id+"-dpos" },
+		{ zp+"/flowWeight", zn_s+" Airflow Weight", "", "", id+"-fwgt" },
+		{ zp+"/overrideDurationMins", zn_s+" Override Duration", "duration", "min", id+"-odur" },
+		{ zp+"/currentTempPrecise", zn_s+" Precise Temperature", "temperature", tuom, id+"-ptemp" },
+		{ zp+"/sensorType", zn_s+" Sensor Type", "enum", "", id+"-stype" },
+		{ zp+"/period", zn_s+" Program Period", "enum", "", id+"-period" },
+	}
+}
+
+func zoneClimateConfigTopic(zn uint8) string {
+	return "homeassistant/climate/infinitive/" + mqttUniqueID(fmt.Sprintf("hvac-zone-%d", zn)) + "/config"
+}
+
+// the Climate entity for a zone, wired to the zone's existing topics
+func zoneClimateDiscovery(zn uint8, name string) *climateDiscovery {
+	zp := mqttTopic(fmt.Sprintf("zone/%d", zn))
+
+	cd := climateDiscovery{
+		Name:                    name,
+		Unique_id:               mqttUniqueID(fmt.Sprintf("hvac-zone-%d", zn)),
+		Modes:                   []string{"off", "cool", "heat", "auto"},
+		Fan_modes:               []string{"high", "med", "low", "auto"},
+		Preset_modes:            []string{"hold", "vacation"},
+		Current_temperature_topic: zp+"/currentTemp",
+		Current_humidity_topic:  zp+"/humidity",
+		Mode_state_topic:        mqttTopic("mode"),
+		// the heat pump only and electric heat only modes are both heat to HA
+		Mode_state_template:     "{{ 'heat' if value in ['electric', 'heatpump'] else value }}",
+		Mode_command_topic:      mqttTopic("mode/set"),
+		Action_topic:            mqttTopic("action"),
+		Fan_mode_state_topic:    zp+"/fanMode",
+		Fan_mode_command_topic:  zp+"/fanMode/set",
+		Preset_mode_state_topic: zp+"/preset",
+		Preset_mode_command_topic: zp+"/preset/set",
+		Temperature_high_state_topic: zp+"/coolSetpoint",
+		Temperature_high_command_topic: zp+"/coolSetpoint/set",
+		Temperature_low_state_topic: zp+"/heatSetpoint",
+		Temperature_low_command_topic: zp+"/heatSetpoint/set",
+		Temperature_unit:        tempUnits(),
+		Temp_step:               1,
+		Precision:               1,
+		Min_temp:                displayTemp(40),
+		Max_temp:                displayTemp(99),
+		Availability:            discoveryAvailability("tstat"),
+		Availability_mode:       "all",
+		Device:                  mqttDevice(),
+	}
+
+	// setpoints are whole degrees F on the bus, so half degrees C are
+	// about as fine as it is worth stepping
+	if tempUnits() == "C" {
+		cd.Temp_step = 0.5
+		cd.Precision = 0.1
+	}
+
+	return &cd
+}
+
+// called with the zones found by the poller; (re)announces the zones'
+// Climate entities and sensors when the set of zones or their names change,
+// and withdraws those of zones that have gone away
+func mqttSetZones(zones map[uint8]string) {
+	mqttZonesMutex.Lock()
+	changed := len(zones) != len(mqttZones)
+	for zn, name := range zones {
+		if n, ok := mqttZones[zn]; !ok || n != name {
+			changed = true
+		}
+	}
+	gone := []uint8{}
+	for zn := range mqttZones {
+		if _, ok := zones[zn]; !ok {
+			gone = append(gone, zn)
+		}
+	}
+	if changed {
+		mqttZones = zones
+	}
+	mqttZonesMutex.Unlock()
+
+	if !changed {
+		return
+	}
+
+	zl := []int{}
+	for zn := range zones {
+		zl = append(zl, int(zn))
+	}
+	sort.Ints(zl)
+	log.Infof("MQTT: zones are now %v", zl)
+
+	if mqttClient == nil || !mqttClient.IsConnected() {
+		return
+	}
+
+	// an empty retained config removes the entity from HA
+	for _, zn := range gone {
+		_ = mqttClient.Publish(zoneClimateConfigTopic(zn), 0, true, "")
+		for _, v := range zoneDiscoveryTopics(zn, "") {
+			_ = mqttClient.Publish("homeassistant/sensor/infinitive/" + mqttUniqueID(v.Unique_id) + "/config", 0, true, "")
+		}
+	}
+
+	mqttPublishDiscovery(mqttClient)
 }
 
 func init() {
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMqttStateTopics(t *testing.T) {
+	tests := []struct {
+		topic string
+		want  []string
+	}{
+		{"mode/set", []string{"mode"}},
+		{"zone/2/heatSetpoint/set", []string{"zone/2/heatSetpoint"}},
+		{"zone/1/overrideDuration/set", []string{"zone/1/overrideDurationMins"}},
+		{"zone/1/overrideDurationMins/set", []string{"zone/1/overrideDurationMins"}},
+		{"zone/3/preset/set", []string{"zone/3/preset", "zone/3/hold"}},
+		{"vacation/days/set", []string{"vacation/days", "vacation/hours", "vacation/active"}},
+		{"vacation/minTemp/set", []string{"vacation/minTemp"}},
+		{"tstat/deadband/set", []string{"tstat/deadband"}},
+		{"tstat/bogus/set", nil},
+		{"zone/1/bogus/set", nil},
+		{"bogus/set", nil},
+		{"zone/1/heatSetpoint", nil},
+		{"set", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.topic, func(t *testing.T) {
+			if got := mqttStateTopics(strings.Split(tt.topic, "/")); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
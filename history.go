@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// History: every value published to MQTT (whether or not MQTT is in use)
+// is recorded, as it changes, in one file of raw samples per (UTC) day.  The
+// samples are also averaged over each step into a second set of day files,
+// which are kept for longer.  Lines are "unix-ms key value", and for the
+// averaged files "unix-ms key avg min max" or, for text values, the last
+// value in the step:
+//	raw-20240109.log	1704812534123 zone/1/currentTemp 68
+//	avg-20240109.log	1704812400000 zone/1/currentTemp 67.75 67 68
+//				1704812400000 action "cooling"
+// Bools are recorded as 0 and 1, so their average is the fraction of the time
+// they were true.
+
+type historyStore struct {
+	dir     string
+	rawKeep time.Duration
+	step    time.Duration
+	keep    time.Duration
+
+	ch      chan histPoint
+	raw     *os.File
+	avg     *os.File
+	day     string
+	start   time.Time		// of the current step
+	steps   map[string]*histStep
+}
+
+type histPoint struct {
+	t   time.Time
+	key string
+	v   interface{}	// float64 or string
+}
+
+// the values of a key over a step: the average is weighted by how long
+// each value held, and for text is the last value
+type histStep struct {
+	start    time.Time
+	last     time.Time	// of the latest value
+	v        interface{}	// latest value, nil if none yet
+	sum      float64	// of value * ms held, to last
+	held     int64		// ms with a value, to last
+	min, max float64
+}
+
+func newHistStep(start time.Time, v interface{}) *histStep {
+	s := &histStep{start: start, last: start, min: math.Inf(1), max: math.Inf(-1)}
+	if v != nil {
+		s.add(start, v, nil, nil)
+	}
+	return s
+}
+
+// a new value at t, with the least and greatest it took if it is an average
+func (s *histStep) add(t time.Time, v interface{}, lo, hi *float64) {
+	s.hold(t)
+	s.v = v
+	if f, ok := v.(float64); ok {
+		if lo == nil {
+			lo, hi = &f, &f
+		}
+		s.min = math.Min(s.min, *lo)
+		s.max = math.Max(s.max, *hi)
+	}
+}
+
+func (s *histStep) hold(t time.Time) {
+	if f, ok := s.v.(float64); ok {
+		ms := t.Sub(s.last).Milliseconds()
+		s.sum += f * float64(ms)
+		s.held += ms
+	}
+	s.last = t
+}
+
+// the sample for the step ending at end, if there was a value in it
+func (s *histStep) result(end time.Time) (histSample, bool) {
+	s.hold(end)
+	switch v := s.v.(type) {
+	case string:
+		return histSample{T: s.start, V: v}, true
+	case float64:
+		avg := v
+		if s.held > 0 {
+			avg = s.sum / float64(s.held)
+		}
+		lo, hi := s.min, s.max
+		return histSample{T: s.start, V: avg, Min: &lo, Max: &hi}, true
+	}
+	return histSample{}, false
+}
+
+var history *historyStore
+
+// start recording to dir; nothing is recorded if this isn't called
+func openHistory(dir string, rawKeep, step, keep time.Duration) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if step <= 0 || rawKeep < step || keep < rawKeep {
+		return fmt.Errorf("history step must be positive and no longer than the retention times")
+	}
+
+	h := &historyStore{dir: dir, rawKeep: rawKeep, step: step, keep: keep,
+		ch: make(chan histPoint, 1000), steps: map[string]*histStep{}}
+	h.expire(time.Now())
+	go h.recorder()
+	history = h
+	return nil
+}
+
+// called from Cache.update for each changed MQTT value
+func recordHistory(key string, data interface{}) {
+	h := history
+	if h == nil {
+		return
+	}
+
+	var v interface{}
+	switch d := data.(type) {
+	case string:
+		v = d
+	case bool:
+		v = 0.0
+		if d {
+			v = 1.0
+		}
+	default:
+		f, ok := metricValue(data)
+		if !ok {
+			return
+		}
+		v = f
+	}
+
+	// don't hold up the poller if the disk is slow
+	select {
+	case h.ch <- histPoint{time.Now(), key, v}:
+	default:
+		log.Warnf("history: dropped sample of %s", key)
+	}
+}
+
+func formatHistValue(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return strconv.Quote(s)
+	}
+	return strconv.FormatFloat(v.(float64), 'g', -1, 64)
+}
+
+func (h *historyStore) recorder() {
+	tick := time.NewTicker(h.step / 10)
+	defer tick.Stop()
+
+	for {
+		select {
+		case p := <-h.ch:
+			h.endStep(p.t)
+			h.write(p.t, &h.raw, "raw", fmt.Sprintf("%d %s %s\n", p.t.UnixMilli(), p.key, formatHistValue(p.v)))
+
+			s := h.steps[p.key]
+			if s == nil {
+				s = newHistStep(h.start, nil)
+				h.steps[p.key] = s
+			}
+			s.add(p.t, p.v, nil, nil)
+		case now := <-tick.C:
+			h.endStep(now)
+		}
+	}
+}
+
+// write out the averages of the last step if it's over, and start the next
+// with the values as they stand
+func (h *historyStore) endStep(now time.Time) {
+	start := now.Truncate(h.step)
+	if !start.After(h.start) {
+		return
+	}
+
+	keys := make([]string, 0, len(h.steps))
+	for key := range h.steps {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := h.steps[key]
+		r, ok := s.result(h.start.Add(h.step))
+		if !ok {
+			continue
+		}
+		if text, ok := r.V.(string); ok {
+			h.write(r.T, &h.avg, "avg", fmt.Sprintf("%d %s %s\n", r.T.UnixMilli(), key, strconv.Quote(text)))
+		} else {
+			h.write(r.T, &h.avg, "avg", fmt.Sprintf("%d %s %s %s %s\n", r.T.UnixMilli(), key,
+				formatHistValue(r.V), formatHistValue(*r.Min), formatHistValue(*r.Max)))
+		}
+		h.steps[key] = newHistStep(start, s.v)
+	}
+	h.start = start
+}
+
+func histFile(dir, kind string, day time.Time) string {
+	return filepath.Join(dir, kind + "-" + day.UTC().Format("20060102") + ".log")
+}
+
+// append a line to the raw or averaged file for the day of t
+func (h *historyStore) write(t time.Time, f **os.File, kind string, line string) {
+	if day := t.UTC().Format("20060102"); day != h.day {
+		if h.raw != nil {
+			h.raw.Close()
+			h.raw = nil
+		}
+		if h.avg != nil {
+			h.avg.Close()
+			h.avg = nil
+		}
+		h.day = day
+		h.expire(t)
+	}
+
+	if *f == nil {
+		var err error
+		*f, err = os.OpenFile(histFile(h.dir, kind, t), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Errorf("history: %s", err)
+			return
+		}
+	}
+	if _, err := (*f).WriteString(line); err != nil {
+		log.Errorf("history: %s", err)
+	}
+}
+
+// remove the day files that have passed their retention time
+func (h *historyStore) expire(now time.Time) {
+	files, _ := filepath.Glob(filepath.Join(h.dir, "*-*.log"))
+	for _, name := range files {
+		kind, day, ok := strings.Cut(strings.TrimSuffix(filepath.Base(name), ".log"), "-")
+		t, err := time.Parse("20060102", day)
+		if !ok || err != nil {
+			continue
+		}
+
+		keep := h.keep
+		if kind == "raw" {
+			keep = h.rawKeep
+		}
+		if now.Sub(t.Add(24 * time.Hour)) > keep {
+			log.Infof("history: removing %s", name)
+			os.Remove(name)
+		}
+	}
+}
+
+// the most steps a query can be split into
+const historyMaxSteps = 10000
+
+// a time given as RFC 3339 or unix seconds, or def if none
+func parseHistoryTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+type histSample struct {
+	T   time.Time   `json:"t"`
+	V   interface{} `json:"v"`
+	Min *float64    `json:"min,omitempty"`
+	Max *float64    `json:"max,omitempty"`
+}
+
+type histSeries struct {
+	Key     string       `json:"key"`
+	Samples []histSample `json:"samples"`
+}
+
+// the recorded values of keys between from and to, from the raw samples if
+// they go back that far; with step > 0, averaged (or for text the last value)
+// over each step, with the value carried forward over steps without a change
+func (h *historyStore) query(keys []string, from, to time.Time, step time.Duration) []histSeries {
+	kind := "raw"
+	if time.Since(from) > h.rawKeep {
+		kind = "avg"
+		if step < h.step {
+			step = h.step
+		}
+	}
+	if step > 0 {
+		from = from.Truncate(step)
+	}
+
+	want := map[string]int{}
+	series := make([]histSeries, len(keys))
+	for i, key := range keys {
+		want[key] = i
+		series[i] = histSeries{Key: key, Samples: []histSample{}}
+	}
+	before := make([]*histSample, len(keys))	// the last value before from
+
+	// from the day before, for the value at from
+	for day := from.UTC().Truncate(24 * time.Hour).Add(-24 * time.Hour); !day.After(to); day = day.Add(24 * time.Hour) {
+		f, err := os.Open(histFile(h.dir, kind, day))
+		if err != nil {
+			continue
+		}
+
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			s, key, ok := parseHistLine(sc.Text())
+			i, wanted := want[key]
+			if !ok || !wanted || s.T.After(to) {
+				continue
+			}
+			if s.T.Before(from) {
+				s.T, s.Min, s.Max = from, nil, nil
+				before[i] = &s
+			} else {
+				series[i].Samples = append(series[i].Samples, s)
+			}
+		}
+		f.Close()
+	}
+
+	for i := range series {
+		if before[i] != nil && (len(series[i].Samples) == 0 || series[i].Samples[0].T.After(from)) {
+			series[i].Samples = append([]histSample{*before[i]}, series[i].Samples...)
+		}
+		if step > 0 {
+			series[i].Samples = downsample(series[i].Samples, from, to, step)
+		}
+	}
+	return series
+}
+
+func parseHistLine(line string) (histSample, string, bool) {
+	f := strings.SplitN(line, " ", 3)
+	if len(f) < 3 {
+		return histSample{}, "", false
+	}
+	ms, err := strconv.ParseInt(f[0], 10, 64)
+	if err != nil {
+		return histSample{}, "", false
+	}
+	s := histSample{T: time.UnixMilli(ms)}
+
+	if strings.HasPrefix(f[2], "\"") {
+		text, err := strconv.Unquote(f[2])
+		s.V = text
+		return s, f[1], err == nil
+	}
+
+	vals := []float64{}
+	for _, vs := range strings.Fields(f[2]) {
+		v, err := strconv.ParseFloat(vs, 64)
+		if err != nil {
+			return histSample{}, "", false
+		}
+		vals = append(vals, v)
+	}
+	// a value, or an average with its min and max
+	if len(vals) != 1 && len(vals) != 3 {
+		return histSample{}, "", false
+	}
+	s.V = vals[0]
+	if len(vals) == 3 {
+		s.Min, s.Max = &vals[1], &vals[2]
+	}
+	return s, f[1], true
+}
+
+// average the samples over each step from from to to
+func downsample(samples []histSample, from, to time.Time, step time.Duration) []histSample {
+	out := []histSample{}
+	var v interface{}	// carried from the last step
+	i := 0
+	for t := from; t.Before(to); t = t.Add(step) {
+		st := newHistStep(t, v)
+		for ; i < len(samples) && samples[i].T.Before(t.Add(step)); i++ {
+			st.add(samples[i].T, samples[i].V, samples[i].Min, samples[i].Max)
+		}
+
+		end := t.Add(step)
+		if end.After(to) {
+			end = to
+		}
+		if r, ok := st.result(end); ok {
+			out = append(out, r)
+		}
+		v = st.v
+	}
+	return out
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseHistLine(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+
+	tests := []struct {
+		name   string
+		line   string
+		key    string
+		sample histSample
+		ok     bool
+	}{
+		{"raw", "1704812534123 zone/1/currentTemp 68", "zone/1/currentTemp",
+			histSample{T: time.UnixMilli(1704812534123), V: 68.0}, true},
+		{"average", "1704812400000 blowerRPM 425.5 0 851", "blowerRPM",
+			histSample{T: time.UnixMilli(1704812400000), V: 425.5, Min: f(0), Max: f(851)}, true},
+		{"text", `1704812400000 action "cooling"`, "action",
+			histSample{T: time.UnixMilli(1704812400000), V: "cooling"}, true},
+		{"text with spaces", `1704812400000 zone/1/name "Living Room"`, "zone/1/name",
+			histSample{T: time.UnixMilli(1704812400000), V: "Living Room"}, true},
+		{"no value", "1704812400000 blowerRPM ", "", histSample{}, false},
+		{"two values", "1704812400000 blowerRPM 1 2", "", histSample{}, false},
+		{"four values", "1704812400000 blowerRPM 1 2 3 4", "", histSample{}, false},
+		{"bad number", "1704812400000 blowerRPM fast", "", histSample{}, false},
+		{"bad time", "yesterday blowerRPM 850", "", histSample{}, false},
+		{"bad text", `1704812400000 action "cooling`, "action", histSample{T: time.UnixMilli(1704812400000), V: ""}, false},
+		{"short", "1704812400000 blowerRPM", "", histSample{}, false},
+		{"empty", "", "", histSample{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, key, ok := parseHistLine(tt.line)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if key != tt.key || !reflect.DeepEqual(s, tt.sample) {
+				t.Errorf("got %s %+v, want %s %+v", key, s, tt.key, tt.sample)
+			}
+		})
+	}
+}
+
+func TestDownsample(t *testing.T) {
+	t0 := time.Unix(1704812400, 0)
+	at := func(mins float64) time.Time { return t0.Add(time.Duration(mins * float64(time.Minute))) }
+	f := func(v float64) *float64 { return &v }
+
+	tests := []struct {
+		name    string
+		samples []histSample
+		to      time.Time
+		step    time.Duration
+		want    []histSample
+	}{
+		{"time weighted", []histSample{{T: at(0), V: 0.0}, {T: at(4), V: 850.0}}, at(5), 5 * time.Minute,
+			[]histSample{{T: at(0), V: 170.0, Min: f(0), Max: f(850)}}},
+		{"carried forward", []histSample{{T: at(0), V: 68.0}}, at(15), 5 * time.Minute,
+			[]histSample{
+				{T: at(0), V: 68.0, Min: f(68), Max: f(68)},
+				{T: at(5), V: 68.0, Min: f(68), Max: f(68)},
+				{T: at(10), V: 68.0, Min: f(68), Max: f(68)}}},
+		{"nothing before the first sample", []histSample{{T: at(7), V: 70.0}}, at(10), 5 * time.Minute,
+			[]histSample{{T: at(5), V: 70.0, Min: f(70), Max: f(70)}}},
+		{"averages keep their range", []histSample{{T: at(0), V: 1.0, Min: f(0), Max: f(2)}, {T: at(5), V: 3.0, Min: f(3), Max: f(3)}}, at(10), 10 * time.Minute,
+			[]histSample{{T: at(0), V: 2.0, Min: f(0), Max: f(3)}}},
+		{"text takes the last", []histSample{{T: at(0), V: "idle"}, {T: at(3), V: "heating"}}, at(10), 5 * time.Minute,
+			[]histSample{{T: at(0), V: "heating"}, {T: at(5), V: "heating"}}},
+		{"partial last step", []histSample{{T: at(0), V: 0.0}, {T: at(6), V: 10.0}}, at(8), 5 * time.Minute,
+			[]histSample{{T: at(0), V: 0.0, Min: f(0), Max: f(0)}, {T: at(5), V: 20.0 / 3, Min: f(0), Max: f(10)}}},
+		{"no samples", []histSample{}, at(10), 5 * time.Minute, []histSample{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := downsample(tt.samples, t0, tt.to, tt.step)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %s, want %s", histString(got), histString(tt.want))
+			}
+		})
+	}
+}
+
+func histString(samples []histSample) string {
+	s := ""
+	for _, h := range samples {
+		s += h.T.Format("15:04") + "=" + formatHistValue(h.V)
+		if h.Min != nil {
+			s += "(" + formatHistValue(*h.Min) + "-" + formatHistValue(*h.Max) + ")"
+		}
+		s += " "
+	}
+	return s
+}
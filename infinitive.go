@@ -6,8 +6,11 @@ import (
 	"flag"
 	"fmt"
 	"encoding/hex"
+	"errors"
 	"os"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -15,19 +18,22 @@ import (
 
 type TStatZoneConfig struct {
 	ZoneNumber      uint8  `json:"zoneNumber,omitempty"`
-	CurrentTemp     uint8  `json:"currentTemp"`
+	CurrentTemp     float32 `json:"currentTemp"`
 	CurrentHumidity uint8  `json:"currentHumidity"`
 	TargetHumidity  uint8  `json:"targetHumidity"`
+	CurrentTempPrecise float32 `json:"currentTempPrecise,omitempty"`
+	SensorType      string `json:"sensorType,omitempty"`
 	ZoneName	string `json:"zoneName"`
 	FanMode         string `json:"fanMode"`
 	Hold            *bool  `json:"hold"`
 	Preset          string `json:"preset"`
-	HeatSetpoint    uint8  `json:"heatSetpoint"`
-	CoolSetpoint    uint8  `json:"coolSetpoint"`
+	HeatSetpoint    float32 `json:"heatSetpoint"`
+	CoolSetpoint    float32 `json:"coolSetpoint"`
 	OvrdDuration	string `json:"overrideDuration"`
-	OvrdDurationMins uint16 `json:"overrideDurationMins"`
+	OvrdDurationMins *uint16 `json:"overrideDurationMins"`
+	Period          string `json:"period,omitempty"`
 	// the following are global and should be removed from per-zone but are left in for compatibility for now
-	OutdoorTemp     uint8  `json:"outdoorTemp"`
+	OutdoorTemp     float32 `json:"outdoorTemp"`
 	Mode            string `json:"mode"`
 	Stage           uint8  `json:"stage"`
 	Action          string `json:"action"`
@@ -36,7 +42,10 @@ type TStatZoneConfig struct {
 
 type TStatZonesConfig struct {
 	Zones             []TStatZoneConfig  `json:"zones,omitempty"`
-	OutdoorTemp       uint8  `json:"outdoorTemp"`
+	OutdoorTemp       float32 `json:"outdoorTemp"`
+	OutdoorTempPrecise *float32 `json:"outdoorTempPrecise,omitempty"`
+	TempUnits         string `json:"tempUnits"`
+	RawHumidity       *uint8 `json:"rawHumidity,omitempty"`
 	Mode              string `json:"mode"`
 	Stage             uint8  `json:"stage"`
 	Action            string `json:"action"`
@@ -62,6 +71,23 @@ type DamperPosition struct {
 	DamperPos   [8]uint8 `json:"damperPosition"`
 }
 
+// from the thermostat's periodic 04.20 broadcast
+type TStatBroadcast struct {
+	OutdoorTemp float32 `json:"outdoorTemp"`
+	Humidity    uint8   `json:"humidity"`
+}
+
+// program period and active setpoints per zone, from 04.1f writes
+type ZoneProgram struct {
+	Period       string `json:"period"`
+	HeatSetpoint float32 `json:"heatSetpoint"`
+	CoolSetpoint float32 `json:"coolSetpoint"`
+}
+
+type ZonePrograms struct {
+	Zones [8]ZoneProgram `json:"zones"`
+}
+
 var zoneWeight [8]float32
 
 type Logger struct {
@@ -81,6 +107,23 @@ func holdTime(ht uint16) string {
 	return fmt.Sprintf("%d:%02d", ht/60, ht % 60)
 }
 
+// longest override the thermostat allows, in minutes
+const maxHoldTime = 24 * 60
+
+// parse an override duration in the form H:MM
+func parseHoldTime(s string) (uint16, bool) {
+	hm := strings.Split(s, ":")
+	if len(hm) != 2 || len(hm[1]) != 2 {
+		return 0, false
+	}
+	h, err1 := strconv.ParseUint(hm[0], 10, 16)
+	m, err2 := strconv.ParseUint(hm[1], 10, 16)
+	if err1 != nil || err2 != nil || m > 59 || h * 60 + m > maxHoldTime {
+		return 0, false
+	}
+	return uint16(h * 60 + m), true
+}
+
 // get vacation config and status
 func getVacationConfig() (*APIVacationConfig, bool) {
 	vac := TStatVacationParams{}
@@ -108,8 +151,13 @@ func getZonesConfig() (*TStatZonesConfig, bool) {
 		return nil, false
 	}
 
+	// high-res temps are a bonus; carry on without them if the read fails
+	temps := TStatZoneTemps{}
+	tempsOk := infinity.ReadTable(devTSTAT, &temps)
+
 	tstat := TStatZonesConfig{
-		OutdoorTemp:       params.OutdoorAirTemp,
+		OutdoorTemp:       displayTemp(float32(params.OutdoorAirTemp)),
+		TempUnits:         tempUnits(),
 		Mode:              rawModeToString(params.Mode & 0xf),
 		Stage:             params.Mode >> 5,
 		Action:            rawActionToString(params.Mode >> 5),
@@ -117,6 +165,7 @@ func getZonesConfig() (*TStatZonesConfig, bool) {
 	}
 
 	zoneArr := [8]TStatZoneConfig{}
+	progs, progsOk := getZonePrograms()
 
 	zc := 0
 	for zi := range params.ZCurrentTemp {
@@ -130,128 +179,114 @@ func getZonesConfig() (*TStatZonesConfig, bool) {
 
 			zoneArr[zc] = TStatZoneConfig{
 					ZoneNumber:       uint8(zi+1),
-					CurrentTemp:      params.ZCurrentTemp[zi],
+					CurrentTemp:      displayTemp(float32(params.ZCurrentTemp[zi])),
 					CurrentHumidity:  params.ZCurrentHumidity[zi],
 					FanMode:          rawFanModeToString(cfg.ZFanMode[zi]),
 					Hold:             &holdz,
 					Preset:           presetz,
-					HeatSetpoint:     cfg.ZHeatSetpoint[zi],
-					CoolSetpoint:     cfg.ZCoolSetpoint[zi],
+					HeatSetpoint:     displayTemp(float32(cfg.ZHeatSetpoint[zi])),
+					CoolSetpoint:     displayTemp(float32(cfg.ZCoolSetpoint[zi])),
 					OvrdDuration:     holdTime(cfg.ZOvrdDuration[zi]),
-					OvrdDurationMins: cfg.ZOvrdDuration[zi],
+					OvrdDurationMins: &cfg.ZOvrdDuration[zi],
 					ZoneName:         string(bytes.Trim(cfg.ZName[zi][:], " \000")) }
 
+			if progsOk {
+				zoneArr[zc].Period = progs.Zones[zi].Period
+			}
+
+			if tempsOk {
+				zt := decodeFields(&temps, zi)
+				zoneArr[zc].CurrentTempPrecise = zt["currentTempPrecise"].(float32)
+				zoneArr[zc].SensorType = zt["sensorType"].(string)
+			}
+
 			zc++
 		}
 	}
 
 	tstat.Zones = zoneArr[0:zc]
 
+	// same for the precise outdoor temp and raw humidity
+	actuals := TStatActuals{}
+	if infinity.ReadTable(devTSTAT, &actuals) {
+		a := decodeFields(&actuals, 0)
+		odt := a["outdoorTempPrecise"].(float32)
+		rh := a["rawHumidity"].(uint8)
+		tstat.OutdoorTempPrecise = &odt
+		tstat.RawHumidity = &rh
+	}
+
 	return &tstat, true
 }
 
 
+var errWriteFailed = errors.New("no response from thermostat to write")
+
 // write a change to a single parameter of a single zone or global config
 // zn == 0 for global params or 1-8 for zone params
-// returns ok == true
-func putConfig(zone string, param string, value string) bool {
-	params := TStatZoneParams{}
-	flags := byte(0)
-
+// returns an error if the value is invalid or the write fails
+func putConfig(zone string, param string, value string) error {
 	zn, err := strconv.Atoi(zone)
 	if err != nil {
-		log.Errorf("putConfig: invalid zone value '%s'", zone)
-		return false
+		return fmt.Errorf("invalid zone value '%s'", zone)
 	}
 	zi := zn - 1
 
 	// zone parameters
 	if (zn >= 1 && zn <= 8) {
+		params := TStatZoneParams{}
+		var v interface{} = value
+
 		switch param {
-		case "fanMode":
-			if mode, ok := stringFanModeToRaw(value); !ok {
-				log.Errorf("putConfig: invalid fan mode name '%s' for zone %d", value, zn)
-				return false
-			} else {
-				params.ZFanMode[zi] = mode
-				flags |= 0x01
-			}
-		case "coolSetpoint":
-			if val, err := strconv.ParseUint(value, 10, 8); err != nil {
-				log.Errorf("putConfig: invalid cool setpoint value '%s' for zone %d", value, zn)
-				return false
-			} else {
-				params.ZCoolSetpoint[zi] = uint8(val)
-				flags |= 0x08
-			}
-		case "heatSetpoint":
-			if val, err := strconv.ParseUint(value, 10, 8); err != nil {
-				log.Errorf("putConfig: invalid heat setpoint value '%s' for zone %d", value, zn)
-				return false
-			} else {
-				params.ZHeatSetpoint[zi] = uint8(val)
-				flags |= 0x04
-			}
-		case "hold":	// dedicated 'hold' semantics
-			var val bool
+		case "preset":	// 'preset' semantics to control hold and vacation
 			switch value {
-				case "true":
-					val = true
-				case "false":
-					val = false
-				default:
-					log.Errorf("putConfig: invalid hold value '%s' for zone %d", value, zn)
-					return false
-				}
-			if val {
-				params.ZoneHold = 0x01 << zi
+			case "hold":
+				v = true
+			case "none":
+				v = false
+			case "vacation":	// for the whole system, not just this zone
+				return putVacationConfig("active", "true")
+			default:
+				return fmt.Errorf("invalid preset value '%s' for zone %d", value, zn)
 			}
-			flags |= 0x02
-		case "preset":	// 'preset' semantics to control hold - extend this if we add more presets
-			var val bool
-			switch value {
-				case "hold":
-					val = true
-				case "none":
-					val = false
-				default:
-					log.Errorf("putConfig: invalid preset value '%s' for zone %d", value, zn)
-					return false
+			if vac, ok := getVacationConfig(); ok && *vac.Active {
+				if err := putVacationConfig("active", "false"); err != nil {
+					return err
 				}
-			if val {
-				params.ZoneHold = 0x01 << zi
 			}
-			flags |= 0x02
-		default:
-			log.Errorf("putConfig: invalid parameter name '%s' for zone %d", param, zn)
-			return false
+			param = "hold"
+		case "overrideDuration":
+			mins, ok := parseHoldTime(value)
+			if !ok {
+				return fmt.Errorf("invalid override duration '%s' for zone %d", value, zn)
+			}
+			param, v = "overrideDurationMins", float64(mins)
 		}
 
-		if flags != 0 {
-			log.Infof("calling WriteTableZ with flags: %d, 0x%x", zi, flags)
-			infinity.WriteTableZ(devTSTAT, params, uint8(zi), flags)
+		flags, err := encodeField(&params, zi, param, v)
+		if err != nil {
+			return fmt.Errorf("zone %d: %s", zn, err)
 		}
 
-		return true
+		log.Infof("calling WriteTableZ with flags: %d, 0x%x", zi, flags)
+		if !infinity.WriteTableZ(devTSTAT, params, uint8(zi), flags) {
+			return errWriteFailed
+		}
+		return nil
 	} else if zn == 0 {
-		switch param {
-		case "mode":
-			if mode, ok := stringModeToRaw(value); !ok {
-				log.Errorf("putConfig: invalid mode value '%s'", value)
-				return false
-			} else {
-				p := TStatCurrentParams{Mode: mode}
-				infinity.WriteTable(devTSTAT, p, 0x10)
-				return true
-			}
-		default:
-			log.Errorf("putConfig: invalid parameter name '%s'", param)
-			return false
+		params := TStatCurrentParams{}
+		flags, err := encodeField(&params, 0, param, value)
+		if err != nil {
+			return err
+		}
+
+		if !infinity.WriteTable(devTSTAT, params, flags) {
+			return errWriteFailed
 		}
+		return nil
 	}
 
-	log.Errorf("putConfig: invalid zone number %d", zn)
-	return false
+	return fmt.Errorf("invalid zone number %d", zn)
 }
 
 func getZNConfig(zi int) (*TStatZoneConfig, bool) {
@@ -278,85 +313,232 @@ func getZNConfig(zi int) (*TStatZoneConfig, bool) {
 		presetz = "hold"
 	}
 
-	return &TStatZoneConfig{
-		CurrentTemp:     params.ZCurrentTemp[zi],
+	temps := TStatZoneTemps{}
+	tempsOk := infinity.ReadTable(devTSTAT, &temps)
+
+	zc := TStatZoneConfig{
+		CurrentTemp:     displayTemp(float32(params.ZCurrentTemp[zi])),
 		CurrentHumidity: params.ZCurrentHumidity[zi],
-		OutdoorTemp:     params.OutdoorAirTemp,
+		OutdoorTemp:     displayTemp(float32(params.OutdoorAirTemp)),
 		Mode:            rawModeToString(params.Mode & 0xf),
 		Stage:           params.Mode >> 5,
 		Action:          rawActionToString(params.Mode >> 5),
 		FanMode:         rawFanModeToString(cfg.ZFanMode[zi]),
 		Hold:            &hold,
 		Preset:          presetz,
-		HeatSetpoint:    cfg.ZHeatSetpoint[zi],
-		CoolSetpoint:    cfg.ZCoolSetpoint[zi],
+		HeatSetpoint:    displayTemp(float32(cfg.ZHeatSetpoint[zi])),
+		CoolSetpoint:    displayTemp(float32(cfg.ZCoolSetpoint[zi])),
 		OvrdDuration:    holdTime(cfg.ZOvrdDuration[zi]),
-		OvrdDurationMins: cfg.ZOvrdDuration[zi],
+		OvrdDurationMins: &cfg.ZOvrdDuration[zi],
 		ZoneName:        string(bytes.Trim(cfg.ZName[zi][:], " \000")),
 		TargetHumidity:  cfg.ZTargetHumidity[zi],
 		RawMode:         params.Mode,
-	}, true
+	}
+
+	if tempsOk {
+		zt := decodeFields(&temps, zi)
+		zc.CurrentTempPrecise = zt["currentTempPrecise"].(float32)
+		zc.SensorType = zt["sensorType"].(string)
+	}
+
+	return &zc, true
 }
 
 // write a change to a single parameter of a vacation setting
-// returns ok == true
-func putVacationConfig(param string, value string) bool {
+// returns an error if the value is invalid or the write fails
+func putVacationConfig(param string, value string) error {
 	params := TStatVacationParams{}
 	apiConfig := APIVacationConfig{}
 
 	switch param {
 	case "days":
 		if val, err := strconv.ParseUint(value, 10, 8); err != nil {
-			log.Errorf("putVacationConfig: invalid days value '%s'", value)
-			return false
+			return fmt.Errorf("invalid days value '%s'", value)
 		} else {
 			v8 := uint8(val)
 			apiConfig.Days = &v8
 		}
 	case "hours":
 		if val, err := strconv.ParseUint(value, 10, 16); err != nil {
-			log.Errorf("putVacationConfig: invalid days value '%s'", value)
-			return false
+			return fmt.Errorf("invalid hours value '%s'", value)
 		} else {
 			v16 := uint16(val)
 			apiConfig.Hours = &v16
 		}
+	case "active":
+		if val, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("invalid active value '%s'", value)
+		} else {
+			apiConfig.Active = &val
+		}
+	case "minTemp", "maxTemp":
+		if val, err := strconv.ParseFloat(value, 32); err != nil {
+			return fmt.Errorf("invalid %s value '%s'", param, value)
+		} else {
+			v32 := float32(val)
+			if param == "minTemp" {
+				apiConfig.MinTemperature = &v32
+			} else {
+				apiConfig.MaxTemperature = &v32
+			}
+		}
+	case "minHumidity", "maxHumidity":
+		if val, err := strconv.ParseUint(value, 10, 8); err != nil {
+			return fmt.Errorf("invalid %s value '%s'", param, value)
+		} else {
+			v8 := uint8(val)
+			if param == "minHumidity" {
+				apiConfig.MinHumidity = &v8
+			} else {
+				apiConfig.MaxHumidity = &v8
+			}
+		}
+	case "fanMode":
+		apiConfig.FanMode = &value
 	default:
-		log.Errorf("putVacationConfig: invalid parameter name '%s'", param)
-		return false
+		return fmt.Errorf("invalid parameter name '%s'", param)
 	}
 
-	flags := params.fromAPI(&apiConfig)
+	flags, err := params.fromAPI(&apiConfig)
+	if err != nil {
+		return err
+	}
 
 	if flags != 0 {
 		log.Infof("putVacationConfig: calling WriteTable with flags: 0x%x", flags)
-		infinity.WriteTable(devTSTAT, params, flags)
+		if !infinity.WriteTable(devTSTAT, params, flags) {
+			return errWriteFailed
+		}
 	} else {
 		log.Warn("putVacationConfig: nothing to write")
 	}
 
-	return true
+	return nil
+}
+
+
+// read the schedule tables for all seven days
+func getWeekSchedule() (*[7]TStatDaySchedule, bool) {
+	week := [7]TStatDaySchedule{}
+	for day := range week {
+		ok := infinity.Read(devTSTAT, scheduleTableAddr(day), &week[day])
+		if !ok {
+			return nil, false
+		}
+	}
+
+	return &week, true
 }
 
+// get the weekly schedule for the given zones (indexes 0-7)
+func getSchedule(zis []int) (*APISchedule, bool) {
+	week, ok := getWeekSchedule()
+	if !ok {
+		return nil, false
+	}
+
+	sched := APISchedule{Zones: []APIZoneSchedule{}}
+	for _, zi := range zis {
+		zs := APIZoneSchedule{ZoneNumber: uint8(zi + 1), Days: make(map[string][]APISchedulePeriod)}
+		for day := range week {
+			zs.Days[scheduleDays[day]] = week[day].toAPI(zi)
+		}
+		sched.Zones = append(sched.Zones, zs)
+	}
+
+	return &sched, true
+}
+
+// write changes to the weekly schedule; only the zones and days mentioned are changed
+// experimental, see below
+func putSchedule(sched *APISchedule) error {
+	week, ok := getWeekSchedule()
+	if !ok {
+		return fmt.Errorf("timed out reading schedule")
+	}
+
+	var changed [7]bool
+	for _, zs := range sched.Zones {
+		if zs.ZoneNumber < 1 || zs.ZoneNumber > 8 {
+			return fmt.Errorf("invalid zone number %d", zs.ZoneNumber)
+		}
+		zi := int(zs.ZoneNumber) - 1
+
+		for name, periods := range zs.Days {
+			day := -1
+			for d, dn := range scheduleDays {
+				if dn == name {
+					day = d
+				}
+			}
+			if day < 0 {
+				return fmt.Errorf("invalid day name '%s'", name)
+			}
 
-func getTstatSettings() (*TStatSettings, bool) {
+			if err := week[day].fromAPI(zi, periods); err != nil {
+				return fmt.Errorf("zone %d %s: %s", zs.ZoneNumber, name, err)
+			}
+			changed[day] = true
+		}
+	}
+
+	// Experimental: the flags the thermostat expects for a schedule write
+	// aren't known.  The whole day is written back, every zone included
+	// (those not being changed as they were read), with every field
+	// flagged and no zone index.
+	for day := range week {
+		if changed[day] {
+			addr := scheduleTableAddr(day)
+			log.Infof("putSchedule: writing %s schedule", scheduleDays[day])
+			if !infinity.Write(devTSTAT, addr[:], []byte{0x00, 0xff, 0xff}, week[day]) {
+				return fmt.Errorf("timed out writing %s schedule", scheduleDays[day])
+			}
+		}
+	}
+
+	return nil
+}
+
+func getTstatSettings() (map[string]interface{}, bool) {
 	tss := TStatSettings{}
 	ok := infinity.ReadTable(devTSTAT, &tss)
 	if !ok {
 		return nil, false
 	}
 
-	return &TStatSettings{
-		BacklightSetting: tss.BacklightSetting,
-		AutoMode:         tss.AutoMode,
-		DeadBand:         tss.DeadBand,
-		CyclesPerHour:    tss.CyclesPerHour,
-		SchedulePeriods:  tss.SchedulePeriods,
-		ProgramsEnabled:  tss.ProgramsEnabled,
-		TempUnits:        tss.TempUnits,
-		DealerName:       tss.DealerName,
-		DealerPhone:      tss.DealerPhone,
-	}, true
+	return decodeFields(&tss, 0), true
+}
+
+// write a change to a single thermostat setting
+func putTstatSettings(param string, value string) error {
+	params := TStatSettings{}
+	flags, err := encodeField(&params, 0, param, value)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("putTstatSettings: calling WriteTable with flags: 0x%x", flags)
+	if !infinity.WriteTable(devTSTAT, params, flags) {
+		return errWriteFailed
+	}
+
+	if param == "tempUnits" {
+		updateTempUnits(value)
+	}
+	return nil
+}
+
+// follow a change of the thermostat's display units, re-announcing the
+// HA discovery topics since their units of measurement change with it
+func updateTempUnits(units string) {
+	if !setTempUnits(units) {
+		return
+	}
+
+	log.Infof("temperature units are now %s", tempUnits())
+	if mqttClient != nil && mqttClient.IsConnected() {
+		mqttPublishDiscovery(mqttClient)
+	}
 }
 
 func getRawData(dev uint16, tbl []byte) {
@@ -391,6 +573,15 @@ func getHeatPump() (HeatPump, bool) {
 	return *th, true
 }
 
+func getZonePrograms() (ZonePrograms, bool) {
+	h := wsCache.get("programs")
+	th, ok := h.(*ZonePrograms)
+	if !ok {
+		return ZonePrograms{}, false
+	}
+	return *th, true
+}
+
 func getDamperPosition() (DamperPosition, bool) {
 	h := wsCache.get("damperpos")
 	th, ok := h.(*DamperPosition)
@@ -402,25 +593,49 @@ func getDamperPosition() (DamperPosition, bool) {
 
 func statePoller(monArray []uint16) {
 	mon_i := 0
+	poll_i := 0
 	for {
+		// thermostat settings rarely change so only check them occasionally
+		if poll_i % 30 == 0 {
+			tss := TStatSettings{}
+			if infinity.ReadTable(devTSTAT, &tss) {
+				c3 := decodeFields(&tss, 0)
+				checkReminders(tss.Unknown1)
+				wsCache.update("settings", c3)
+				updateTempUnits(c3["tempUnits"].(string))
+				for name, v := range c3 {
+					if writableField(TStatSettings{}, name) {
+						mqttCache.update("mqtt/tstat/"+name, v)
+					}
+				}
+			}
+		}
+		poll_i++
+
 		// called once for all zones
 		c1, c1ok := getZonesConfig()
 		c2, c2ok := getVacationConfig()
 
 		if c1ok {
 			wsCache.update("tstat", c1)
-			pf := "mqtt/infinitive"
+			pf := "mqtt"
 			var hum uint8
+			zones := map[uint8]string{}
 			for zi := range c1.Zones {
+				zones[c1.Zones[zi].ZoneNumber] = c1.Zones[zi].ZoneName
 				zp := fmt.Sprintf("%s/zone/%d", pf, c1.Zones[zi].ZoneNumber)
 				mqttCache.update(zp+"/currentTemp", c1.Zones[zi].CurrentTemp)
 				mqttCache.update(zp+"/humidity", c1.Zones[zi].CurrentHumidity)
+				if c1.Zones[zi].SensorType != "" {
+					mqttCache.update(zp+"/currentTempPrecise", c1.Zones[zi].CurrentTempPrecise)
+					mqttCache.update(zp+"/sensorType", c1.Zones[zi].SensorType)
+				}
 				hum = c1.Zones[zi].CurrentHumidity
 				mqttCache.update(zp+"/coolSetpoint", c1.Zones[zi].CoolSetpoint)
 				mqttCache.update(zp+"/heatSetpoint", c1.Zones[zi].HeatSetpoint)
 				mqttCache.update(zp+"/fanMode", c1.Zones[zi].FanMode)
 				mqttCache.update(zp+"/hold", *c1.Zones[zi].Hold)
-				mqttCache.update(zp+"/overrideDurationMins", c1.Zones[zi].OvrdDurationMins)
+				mqttCache.update(zp+"/overrideDurationMins", *c1.Zones[zi].OvrdDurationMins)
 				if c2ok && *c2.Active {
 					mqttCache.update(zp+"/preset", "vacation")
 				} else {
@@ -431,7 +646,12 @@ func statePoller(monArray []uint16) {
 			if hum > 0 {
 				mqttCache.update(pf+"/humidity", hum)
 			}
+			mqttSetZones(zones)
 			mqttCache.update(pf+"/outdoorTemp", c1.OutdoorTemp)
+			if c1.OutdoorTempPrecise != nil {
+				mqttCache.update(pf+"/outdoorTempPrecise", *c1.OutdoorTempPrecise)
+				mqttCache.update(pf+"/rawHumidity", *c1.RawHumidity)
+			}
 			mqttCache.update(pf+"/mode", c1.Mode)
 			// mqttCache.update(pf+"/action", c1.Action) // replaced by action set from snoop messages
 			mqttCache.update(pf+"/rawMode", c1.RawMode)
@@ -439,7 +659,7 @@ func statePoller(monArray []uint16) {
 
 		if c2ok {
 			wsCache.update("vacation", c2)
-			pf := "mqtt/infinitive/vacation"
+			pf := "mqtt/vacation"
 			mqttCache.update(pf+"/active", *c2.Active)
 			mqttCache.update(pf+"/days", *c2.Days)
 			mqttCache.update(pf+"/hours", *c2.Hours)
@@ -461,16 +681,6 @@ func statePoller(monArray []uint16) {
 	}
 }
 
-func statsPoller() {
-	for {
-		// called once for all zones
-		ss := infinity.getStatsString()
-		log.Info("#STATS# ", ss)
-
-		time.Sleep(time.Second * 15)
-	}
-}
-
 func attachSnoops() {
 	// Snoop Heat Pump responses
 	infinity.snoopResponse(0x5000, 0x51ff, func(frame *InfinityFrame) {
@@ -478,18 +688,24 @@ func attachSnoops() {
 		heatPump, ok := getHeatPump()
 		if ok {
 			if bytes.Equal(frame.data[0:3], []byte{0x00, 0x3e, 0x01}) {
-				heatPump.CoilTemp = float32(binary.BigEndian.Uint16(data[2:4])) / float32(16)
-				heatPump.OutsideTemp = float32(binary.BigEndian.Uint16(data[0:2])) / float32(16)
+				// the coil temp is taken to be the refrigerant temp at the
+				// unit's coil sensor, which near enough follows the outside
+				// temp when idle and is chilled well below it while cooling
+				// (the simulator brings it down toward 40F); the coil-temp
+				// diagnostic relies on that
+				heatPump.CoilTemp = displayTemp(float32(int16(binary.BigEndian.Uint16(data[2:4]))) / float32(16))
+				heatPump.OutsideTemp = displayTemp(float32(int16(binary.BigEndian.Uint16(data[0:2]))) / float32(16))
 				log.Debugf("heat pump coil temp is: %f", heatPump.CoilTemp)
 				log.Debugf("heat pump outside temp is: %f", heatPump.OutsideTemp)
 				wsCache.update("heatpump", &heatPump)
-				mqttCache.update("mqtt/infinitive/coilTemp", heatPump.CoilTemp)
-				mqttCache.update("mqtt/infinitive/outsideTemp", heatPump.OutsideTemp)
+				mqttCache.update("mqtt/coilTemp", heatPump.CoilTemp)
+				mqttCache.update("mqtt/outsideTemp", heatPump.OutsideTemp)
 			} else if bytes.Equal(frame.data[0:3], []byte{0x00, 0x3e, 0x02}) {
 				heatPump.Stage = data[0] >> 1
 				log.Debugf("HP stage is: %d", heatPump.Stage)
 				wsCache.update("heatpump", &heatPump)
-				mqttCache.update("mqtt/infinitive/coolStage", heatPump.Stage)
+				mqttCache.update("mqtt/coolStage", heatPump.Stage)
+				noteRuntime()
 			}
 		}
 	})
@@ -503,12 +719,14 @@ func attachSnoops() {
 				airHandler.BlowerRPM = binary.BigEndian.Uint16(data[1:3])
 				log.Debugf("blower RPM is: %d", airHandler.BlowerRPM)
 				wsCache.update("blower", &airHandler)
-				mqttCache.update("mqtt/infinitive/blowerRPM", airHandler.BlowerRPM)
+				mqttCache.update("mqtt/blowerRPM", airHandler.BlowerRPM)
+				noteRuntime()
 			} else if bytes.Equal(frame.data[0:3], []byte{0x00, 0x03, 0x16}) {
 				airHandler.HeatStage = uint8(data[0])
 				airHandler.AirFlowCFM = binary.BigEndian.Uint16(data[4:6])
 				airHandler.StaticPressure = float32(float32(int(float32(binary.BigEndian.Uint16(data[7:9])) / float32(65536) * 10000 + 0.5))/10000.0)
-				airHandler.ElecHeat = data[0]&0x03 != 0
+				// the heat stage of a fan coil is its heat strips
+				airHandler.ElecHeat = data[2]&0x03 == 0 && data[0]&0x03 != 0 && airHandlerFanCoil()
 				switch {
 				case data[2] & 0x03 != 0:
 					airHandler.Action = "cooling"
@@ -519,10 +737,51 @@ func attachSnoops() {
 				}
 				log.Debugf("air flow CFM is: %d", airHandler.AirFlowCFM)
 				wsCache.update("blower", &airHandler)
-				mqttCache.update("mqtt/infinitive/heatStage", airHandler.HeatStage)
-				mqttCache.update("mqtt/infinitive/action", airHandler.Action)
-				mqttCache.update("mqtt/infinitive/airflowCFM", airHandler.AirFlowCFM)
-				mqttCache.update("mqtt/infinitive/staticPressure", airHandler.StaticPressure)
+				mqttCache.update("mqtt/heatStage", airHandler.HeatStage)
+				mqttCache.update("mqtt/elecHeat", airHandler.ElecHeat)
+				mqttCache.update("mqtt/action", airHandler.Action)
+				mqttCache.update("mqtt/airflowCFM", airHandler.AirFlowCFM)
+				mqttCache.update("mqtt/staticPressure", airHandler.StaticPressure)
+				noteRuntime()
+			}
+		}
+	})
+
+	// Snoop thermostat broadcasts and writes to the zone sensors
+	infinity.snoopWrite(devTSTAT, devTSTAT, func(frame *InfinityFrame) {
+		data := frame.data[3:]
+		if bytes.Equal(frame.data[0:3], []byte{0x00, 0x04, 0x20}) && len(data) >= 11 {
+			bcast := TStatBroadcast{
+				OutdoorTemp: displayTemp(float32(int16(binary.BigEndian.Uint16(data[6:8]))) / float32(16)),
+				Humidity:    data[10],
+			}
+			log.Debugf("thermostat broadcast: outdoor temp %f, humidity %d", bcast.OutdoorTemp, bcast.Humidity)
+			wsCache.update("broadcast", &bcast)
+		} else if bytes.Equal(frame.data[0:3], []byte{0x00, 0x04, 0x1f}) && len(data) >= 8 {
+			// Unverified: zone sensors are taken to be addressed 0x2001 for
+			// zone 1, 0x2101 for zone 2 etc; this hasn't been confirmed on a
+			// multi-zone system.  The raw address is logged below to check it.
+			zi := int(frame.dst>>8) - 0x20
+			if zi < 0 || zi > 7 {
+				log.Debugf("04.1f write to unexpected device %04x", frame.dst)
+				return
+			}
+
+			progs, ok := getZonePrograms()
+			if ok {
+				period := "unknown"
+				if int(data[1]) < len(schedulePeriods) {
+					period = schedulePeriods[data[1]]
+				}
+				progs.Zones[zi] = ZoneProgram{Period: period,
+					HeatSetpoint: displayTemp(float32(data[6])),
+					CoolSetpoint: displayTemp(float32(data[7]))}
+				log.Debugf("zone %d (sensor %04x) program period is: %s", zi+1, frame.dst, period)
+				wsCache.update("programs", &progs)
+				zp := fmt.Sprintf("mqtt/zone/%d", zi+1)
+				mqttCache.update(zp+"/period", period)
+				mqttCache.update(zp+"/activeHeatSetpoint", progs.Zones[zi].HeatSetpoint)
+				mqttCache.update(zp+"/activeCoolSetpoint", progs.Zones[zi].CoolSetpoint)
 			}
 		}
 	})
@@ -538,7 +797,7 @@ func attachSnoops() {
 				for zi := range damperPos.DamperPos {
 					if data[zi] != 0xff {
 						damperPos.DamperPos[zi] = uint8(data[zi])
-						mqttCache.update(fmt.Sprintf("mqtt/infinitive/zone/%d/damperPos", zi+1), uint(damperPos.DamperPos[zi]) * 100 / 15)
+						mqttCache.update(fmt.Sprintf("mqtt/zone/%d/damperPos", zi+1), uint(damperPos.DamperPos[zi]) * 100 / 15)
 						tdw += zoneWeight[zi] * float32(damperPos.DamperPos[zi])
 					}
 				}
@@ -547,7 +806,7 @@ func attachSnoops() {
 					for zi := range damperPos.DamperPos {
 						if data[zi] != 0xff {
 							damperPos.DamperPos[zi] = uint8(data[zi])
-							mqttCache.update(fmt.Sprintf("mqtt/infinitive/zone/%d/flowWeight", zi+1), (zoneWeight[zi] * float32(damperPos.DamperPos[zi]) / tdw))
+							mqttCache.update(fmt.Sprintf("mqtt/zone/%d/flowWeight", zi+1), (zoneWeight[zi] * float32(damperPos.DamperPos[zi]) / tdw))
 						}
 					}
 				}
@@ -569,7 +828,7 @@ func (l *Logger) Open() (ok bool) {
 		log.Errorf("Failed to open resp log file '%s': %s", rlfn, err)
 		ok = false
 	} else {
-		log.Info("Opened resp log file '%s'", rlfn)
+		log.Infof("Opened resp log file '%s'", rlfn)
 		of := l.f
 		l.f = f
 		l.tds = tds
@@ -592,7 +851,7 @@ func (l *Logger) Close() {
 	if l.f != nil {
 		err := l.f.Close()
 		if (err != nil) {
-			log.Warnf("Error on closing resp logger: %", err)
+			log.Warnf("Error on closing resp logger: %s", err)
 		} else {
 			l.f = nil
 		}
@@ -624,10 +883,25 @@ func (l *Logger) LogS(s string) {
 
 func main() {
 	httpPort := flag.Int("httpport", 8080, "HTTP port to listen on")
-	serialPort := flag.String("serial", "", "path to serial port")
+	serialPort := flag.String("serial", "", "path to serial port, or bus transport URL (tcp://host:port, rfc2217://host:port, replay:///path/to/resplog, sim://)")
 	mqttBrokerUrl := flag.String("mqtt", "", "url for mqtt broker")
+	mqttUser := flag.String("mqttuser", "", "username for mqtt broker, if not given in the url (password is taken from MQTTPASS)")
+	mqttCA := flag.String("mqttca", "", "PEM file of CA certificates to verify an ssl:// or wss:// mqtt broker")
+	mqttCert := flag.String("mqttcert", "", "PEM client certificate file for mqtt broker")
+	mqttKey := flag.String("mqttkey", "", "PEM client key file for mqtt broker")
+	mqttInsecure := flag.Bool("mqttinsecure", false, "don't verify the mqtt broker's certificate")
+	mqttPfx := flag.String("mqttprefix", "", "prefix for MQTT topics (default infinitive, or infinitive/SYSID with -sysid)")
+	sysID := flag.String("sysid", "", "ID for this system, to keep MQTT clients and HA entities distinct when several share a broker")
 	doRespLog := flag.Bool("rlog", false, "enable resp log")
 	doDebugLog := flag.Bool("debug", false, "enable debug log level")
+	units := flag.String("units", "auto", "temperature units: F, C or auto to follow the thermostat")
+	stale := flag.Duration("stale", staleTime, "how long a part of the system can be silent before its MQTT data is marked unavailable")
+	historyDir := flag.String("history", "", "directory to keep a history of values in (default none)")
+	historyRaw := flag.Duration("historyraw", 48 * time.Hour, "how long to keep every recorded change")
+	historyStep := flag.Duration("historystep", 5 * time.Minute, "interval to average the history over for keeping longer")
+	historyKeep := flag.Duration("historykeep", 90 * 24 * time.Hour, "how long to keep the averaged history")
+	diagFile := flag.String("diag", "", "JSON file of diagnostic rule settings")
+	runtimeFile := flag.String("runtime", "infinitive-runtime.json", "file to keep the equipment runtime counts in, \"\" for none")
 
 	flag.Parse()
 
@@ -637,6 +911,52 @@ func main() {
 		os.Exit(1)
 	}
 
+	switch *units {
+	case "F", "C":
+		tempUnitsOverride = *units
+		setTempUnits(*units)
+	case "auto":
+	default:
+		fmt.Print("units must be F, C or auto\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	staleTime = *stale
+
+	if *historyDir != "" {
+		if err := openHistory(*historyDir, *historyRaw, *historyStep, *historyKeep); err != nil {
+			fmt.Printf("history: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *diagFile != "" {
+		if err := loadDiagnostics(*diagFile); err != nil {
+			fmt.Printf("diag: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *runtimeFile != "" {
+		if err := openRuntime(*runtimeFile); err != nil {
+			fmt.Printf("runtime: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if !regexp.MustCompile("^[A-Za-z0-9_-]*$").MatchString(*sysID) {
+		fmt.Print("sysid may only contain letters, digits, _ and -\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	mqttSystemID = *sysID
+	if *mqttPfx != "" {
+		mqttPrefix = strings.Trim(*mqttPfx, "/")
+	} else if mqttSystemID != "" {
+		mqttPrefix = "infinitive/" + mqttSystemID
+	}
+
 	loglevel := log.InfoLevel
 	if doDebugLog != nil && *doDebugLog { loglevel = log.DebugLevel }
 	log.SetLevel(loglevel)
@@ -660,6 +980,7 @@ func main() {
 	wsCache.update("blower", airHandler)
 	wsCache.update("heatpump", heatPump)
 	wsCache.update("damperpos", damperPos)
+	wsCache.update("programs", new(ZonePrograms))
 
 	// init zone airflow weights (doesn't seem to be pollable so need to configure these)
 	zoneRelPct := [8]float32{55, 33}
@@ -676,20 +997,35 @@ func main() {
 
 	rawMonTable := []uint16{
 		// 0x3c01, 0x3c03, 0x3c0a, 0x3c0b, 0x3c0c, 0x3c0d, 0x3c0e, 0x3c0f, 0x3c14, 0x3d02, 0x3d03, 
-		0x3b05, 0x3b06, 0x3b0e, 0x3b0f, 0x3d02, 0x3d03,
+		0x3b05, 0x3b06, 0x3b0e, 0x3b0f,
 	}
 
 	attachSnoops()
 	err := infinity.Open()
 	if err != nil {
-		log.Panicf("error opening serial port: %s", err.Error())
+		log.Panicf("error opening bus interface: %s", err.Error())
 	}
 
-	if mqttBrokerUrl != nil {
-		ConnectMqtt(*mqttBrokerUrl, os.Getenv("MQTTPASS"))
+	if *mqttBrokerUrl != "" {
+		err = ConnectMqtt(&MqttConn{
+			url:      *mqttBrokerUrl,
+			username: *mqttUser,
+			password: os.Getenv("MQTTPASS"),
+			caFile:   *mqttCA,
+			certFile: *mqttCert,
+			keyFile:  *mqttKey,
+			insecure: *mqttInsecure,
+		})
+		if err != nil {
+			log.Panicf("error setting up mqtt: %s", err.Error())
+		}
 	}
 
 	go statePoller(rawMonTable)
+	go availabilityMonitor()
+	go deviceProber()
 	go statsPoller()
+	go runtimeMonitor()
+	go diagnosticsMonitor()
 	webserver(*httpPort)
 }
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseHoldTime(t *testing.T) {
+	tests := []struct {
+		in   string
+		mins uint16
+		ok   bool
+	}{
+		{"0:00", 0, true},
+		{"1:30", 90, true},
+		{"12:05", 725, true},
+		{"24:00", 1440, true},
+		{"24:01", 0, false},
+		{"1:60", 0, false},
+		{"1:5", 0, false},
+		{"130", 0, false},
+		{"1:30:00", 0, false},
+		{":30", 0, false},
+		{"-1:30", 0, false},
+		{"a:30", 0, false},
+		{"", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			mins, ok := parseHoldTime(tt.in)
+			if mins != tt.mins || ok != tt.ok {
+				t.Errorf("got %d, %v, want %d, %v", mins, ok, tt.mins, tt.ok)
+			}
+		})
+	}
+}
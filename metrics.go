@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prometheus metrics, in the text exposition format, at /metrics: the bus
+// counters (see protocolStats), request latencies, and gauges for the HVAC
+// state taken from the MQTT value cache.  Temperatures are always in Celsius
+// here.
+
+// a histogram with fixed bucket bounds
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64	// per bucket, with +Inf last
+	sum    float64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.counts[sort.SearchFloat64s(h.bounds, v)]++
+	h.sum += v
+}
+
+// the buckets, sum and count of a histogram, labelled
+func (h *histogram) write(b *bytes.Buffer, name string, labels string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	n := uint64(0)
+	for i, c := range h.counts {
+		n += c
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = strconv.FormatFloat(h.bounds[i], 'g', -1, 64)
+		}
+		fmt.Fprintf(b, "%s_bucket{%sle=\"%s\"} %d\n", name, labels, le, n)
+	}
+	fmt.Fprintf(b, "%s_sum{%s} %g\n", name, strings.TrimSuffix(labels, ","), h.sum)
+	fmt.Fprintf(b, "%s_count{%s} %d\n", name, strings.TrimSuffix(labels, ","), n)
+}
+
+// time from sending a request to its response, or to giving up
+var requestLatency = map[bool]*histogram{
+	true:  newHistogram(0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5),
+	false: newHistogram(0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5),
+}
+
+func observeRequest(ok bool, start time.Time) {
+	requestLatency[ok].observe(time.Since(start).Seconds())
+}
+
+// a gauge taken from an MQTT cache value
+type gaugeDef struct {
+	key  string	// relative to mqtt/ or, for zone gauges, mqtt/zone/N/
+	name string
+	help string
+	temp bool	// in the display units, to be shown in Celsius
+}
+
+var zoneGauges = []gaugeDef{
+	{ "currentTemp", "infinitive_zone_temperature_celsius", "Zone temperature.", true },
+	{ "currentTempPrecise", "infinitive_zone_precise_temperature_celsius", "Zone temperature from the high resolution sensor reading.", true },
+	{ "humidity", "infinitive_zone_humidity_percent", "Zone relative humidity.", false },
+	{ "heatSetpoint", "infinitive_zone_heat_setpoint_celsius", "Zone heating setpoint.", true },
+	{ "coolSetpoint", "infinitive_zone_cool_setpoint_celsius", "Zone cooling setpoint.", true },
+	{ "damperPos", "infinitive_zone_damper_position_percent", "Zone damper opening.", false },
+	{ "flowWeight", "infinitive_zone_airflow_weight", "Zone airflow weight.", false },
+}
+
+var systemGauges = []gaugeDef{
+	{ "outdoorTemp", "infinitive_outdoor_temperature_celsius", "Outdoor temperature reported by the thermostat.", true },
+	{ "humidity", "infinitive_indoor_humidity_percent", "Indoor relative humidity.", false },
+	{ "blowerRPM", "infinitive_blower_rpm", "Blower speed.", false },
+	{ "airflowCFM", "infinitive_airflow_cfm", "Airflow in cubic feet per minute.", false },
+	{ "staticPressure", "infinitive_static_pressure_inches_water", "Static pressure in inches of water.", false },
+	{ "coilTemp", "infinitive_coil_temperature_celsius", "Outdoor coil temperature.", true },
+	{ "outsideTemp", "infinitive_outside_unit_temperature_celsius", "Outdoor temperature measured by the outdoor unit.", true },
+	{ "heatStage", "infinitive_heat_stage", "Current heating stage, 0 when off.", false },
+	{ "coolStage", "infinitive_cool_stage", "Current cooling stage, 0 when off.", false },
+}
+
+// a cache value as a number
+func metricValue(v interface{}) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	case reflect.Bool:
+		if rv.Bool() {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func writeHeader(b *bytes.Buffer, name, help, kind string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeCounter(b *bytes.Buffer, name, help string, v int64) {
+	writeHeader(b, name, help, "counter")
+	fmt.Fprintf(b, "%s %d\n", name, v)
+}
+
+func writeMetrics(b *bytes.Buffer) {
+	c := infinity.stats.snapshot()
+	writeCounter(b, "infinitive_bus_receives_total", "Reads from the bus interface.", c.Receives)
+	writeCounter(b, "infinitive_bus_frames_total", "Valid frames received.", c.Frames)
+	writeCounter(b, "infinitive_bus_framing_errors_total", "Bytes skipped looking for a valid frame.", c.FramingErrors)
+	writeCounter(b, "infinitive_bus_retries_total", "Requests retransmitted for lack of a response.", c.Retries)
+	writeCounter(b, "infinitive_bus_unexpected_frames_total", "Responses received that were not the one expected.", c.Unexpected)
+	writeCounter(b, "infinitive_bus_failures_total", "Requests that got no response.", c.Failed)
+
+	writeHeader(b, "infinitive_bus_requests_total", "Requests sent by infinitive.", "counter")
+	fmt.Fprintf(b, "infinitive_bus_requests_total{op=\"read\"} %d\n", c.Reads + c.TableReads)
+	fmt.Fprintf(b, "infinitive_bus_requests_total{op=\"write\"} %d\n", c.Writes)
+
+	writeHeader(b, "infinitive_bus_request_duration_seconds", "Time from sending a request to its response, or to giving up.", "histogram")
+	requestLatency[true].write(b, "infinitive_bus_request_duration_seconds", "result=\"ok\",")
+	requestLatency[false].write(b, "infinitive_bus_request_duration_seconds", "result=\"failed\",")
+
+	writeHeader(b, "infinitive_device_frames_total", "Frames received from each device.", "counter")
+	for _, d := range getDevices() {
+		fmt.Fprintf(b, "infinitive_device_frames_total{address=\"%s\",device=\"%s\"} %d\n", d.Address, d.Kind, d.Frames)
+	}
+
+	rt := getRuntime(0, 0)
+	writeHeader(b, "infinitive_stage_runtime_seconds_total", "Time each stage of the equipment has run.", "counter")
+	for _, s := range runtimeStages {
+		fmt.Fprintf(b, "infinitive_stage_runtime_seconds_total{stage=\"%s\"} %g\n", s.id, rt.Total[s.id].Seconds)
+	}
+	writeHeader(b, "infinitive_stage_cycles_total", "Times each stage of the equipment has started.", "counter")
+	for _, s := range runtimeStages {
+		fmt.Fprintf(b, "infinitive_stage_cycles_total{stage=\"%s\"} %d\n", s.id, rt.Total[s.id].Cycles)
+	}
+
+	values := mqttCache.dump()
+	celsius := tempUnits() == "C"
+	gauge := func(g gaugeDef, key string, labels string) {
+		v, ok := metricValue(values["mqtt/"+key])
+		if !ok {
+			return
+		}
+		if g.temp && !celsius {
+			v = (v - 32) * 5 / 9
+		}
+		fmt.Fprintf(b, "%s{%sdevice=\"%s\"} %g\n", g.name, labels, topicSubsystem(key), math.Round(v*100)/100)
+	}
+
+	for _, g := range systemGauges {
+		writeHeader(b, g.name, g.help, "gauge")
+		gauge(g, g.key, "")
+	}
+
+	mqttZonesMutex.Lock()
+	zones := []int{}
+	for zn := range mqttZones {
+		zones = append(zones, int(zn))
+	}
+	mqttZonesMutex.Unlock()
+	sort.Ints(zones)
+
+	for _, g := range zoneGauges {
+		writeHeader(b, g.name, g.help, "gauge")
+		for _, zn := range zones {
+			gauge(g, fmt.Sprintf("zone/%d/%s", zn, g.key), fmt.Sprintf("zone=\"%d\",", zn))
+		}
+	}
+
+	list, _ := getAlerts()
+	writeHeader(b, "infinitive_alert_active", "Whether each alert is active.", "gauge")
+	for _, a := range list {
+		v := 0
+		if a.Active {
+			v = 1
+		}
+		fmt.Fprintf(b, "infinitive_alert_active{alert=\"%s\",kind=\"%s\"} %d\n", a.ID, a.Kind, v)
+	}
+}
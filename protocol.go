@@ -3,11 +3,10 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"sync/atomic"
 	"time"
-	"fmt"
 
 	log "github.com/sirupsen/logrus"
-	"github.com/tarm/serial"
 )
 
 const (
@@ -25,42 +24,43 @@ type InfinityProtocolRawRequest struct {
 }
 
 type InfinityProtocolSnoop struct {
+	op     uint8	// opRESPONSE or opWRITE
 	srcMin uint16
 	srcMax uint16
 	cb     snoopCallback
 }
 
+// counts from startup, updated by the reader and broker goroutines
 type protocolStats struct {
-	rcvs	int64	// candidate frames received
-	frerrs	int64	// framing errors
-	frames	int64	// valid frames received
-	fself	int64	// frames addressed to me
-	fother	int64	// frames addressed to others
-	fsnoop	int64	// frames addressed to others, snooped
-
-	sresp	int64	// response msgs ordered
-	srd	int64	// action (originated) msgs ordered
-	srdt	int64	// action (originated) msgs ordered
-	swr	int64	// action (originated) msgs ordered
-
-	aact	int64	// actions originated
-	aretr	int64	// actions retransmitted
-	aother	int64	// something other than expected response when resp expected
-	aok1	int64	// actions processed OK w/o retrans
-	aokN	int64	// actions processed OK a retrans
-	aokms	int64	// total milliseconds of elapsed time for successful transactions (aok1 + aokN)
-	afail	int64	// actions failed
-	afailms	int64	// total milliseconds of elapsed time for failed transactions (afail)
+	rcvs	atomic.Int64	// candidate frames received
+	frerrs	atomic.Int64	// framing errors
+	frames	atomic.Int64	// valid frames received
+	fself	atomic.Int64	// frames addressed to me
+	fother	atomic.Int64	// frames addressed to others
+	fsnoop	atomic.Int64	// frames addressed to others, snooped
+
+	sresp	atomic.Int64	// response msgs ordered
+	srd	atomic.Int64	// action (originated) msgs ordered
+	srdt	atomic.Int64	// action (originated) msgs ordered
+	swr	atomic.Int64	// action (originated) msgs ordered
+
+	aact	atomic.Int64	// actions originated
+	aretr	atomic.Int64	// actions retransmitted
+	aother	atomic.Int64	// something other than expected response when resp expected
+	aok1	atomic.Int64	// actions processed OK w/o retrans
+	aokN	atomic.Int64	// actions processed OK a retrans
+	aokms	atomic.Int64	// total milliseconds of elapsed time for successful transactions (aok1 + aokN)
+	afail	atomic.Int64	// actions failed
+	afailms	atomic.Int64	// total milliseconds of elapsed time for failed transactions (afail)
 }
 
 type InfinityProtocol struct {
 	device     string
-	port       *serial.Port
+	port       InfinityTransport
 	responseCh chan *InfinityFrame
 	actionCh   chan *Action
 	snoops     []InfinityProtocolSnoop
-	statTime   int64		// time stats cleared (unix ms
-	stats	   *protocolStats
+	stats	   protocolStats
 }
 
 type Action struct {
@@ -68,28 +68,29 @@ type Action struct {
 	responseFrame *InfinityFrame
 	ok            bool
 	ch            chan bool
+	probe         bool	// not counted in the stats, see Probe
 }
 
 var readTimeout = time.Second * 5
 
-func (p *InfinityProtocol) openSerial() error {
-	log.Printf("opening serial interface: %s", p.device)
+func (p *InfinityProtocol) openPort() error {
+	log.Printf("opening bus interface: %s", p.device)
 	if p.port != nil {
 		p.port.Close()
+		p.port = nil
 	}
 
-	c := &serial.Config{Name: p.device, Baud: 38400, ReadTimeout: readTimeout}
-	var err error
-	p.port, err = serial.OpenPort(c)
+	port, err := openTransport(p.device)
 	if err != nil {
 		return err
 	}
 
+	p.port = port
 	return nil
 }
 
 func (p *InfinityProtocol) Open() error {
-	err := p.openSerial()
+	err := p.openPort()
 	if err != nil {
 		return err
 	}
@@ -97,7 +98,6 @@ func (p *InfinityProtocol) Open() error {
 	p.responseCh = make(chan *InfinityFrame, 32)
 	p.actionCh = make(chan *Action)
 
-	p.stats = new(protocolStats)
 
 	go p.reader()
 	go p.broker()
@@ -108,35 +108,54 @@ func (p *InfinityProtocol) Open() error {
 func (p *InfinityProtocol) handleFrame(frame *InfinityFrame) *InfinityFrame {
 	// log.Printf("read frame: %s", frame)
 	RLogger.Log(frame)
+	noteFrameSource(frame.src)
+	noteDevice(frame.src)
 
 	switch frame.op {
 	case opRESPONSE:
 		if frame.dst == devSAM {
-			p.stats.fself++
+			p.stats.fself.Add(1)
 			p.responseCh <- frame
 		} else {
-			p.stats.fother++
+			p.stats.fother.Add(1)
 		}
 
-		if len(frame.data) > 3 {
-			for _, s := range p.snoops {
-				if frame.src >= s.srcMin && frame.src <= s.srcMax {
-					s.cb(frame)
-				}
-			}
-		}
+		p.dispatchSnoops(frame)
+	case opERROR:
+		noteErrorFrame(frame)
 	case opWRITE:
+		p.dispatchSnoops(frame)
+
 		if frame.src == devTSTAT && frame.dst == devSAM {
-			p.stats.fself++
+			p.stats.fself.Add(1)
 			return writeAck
 		} else {
-			p.stats.fother++
+			p.stats.fother.Add(1)
 		}
 	}
 
 	return nil
 }
 
+// pass a frame to any snoops registered for its op and source
+func (p *InfinityProtocol) dispatchSnoops(frame *InfinityFrame) {
+	if len(frame.data) <= 3 {
+		return
+	}
+
+	snooped := false
+	for _, s := range p.snoops {
+		if frame.op == s.op && frame.src >= s.srcMin && frame.src <= s.srcMax {
+			s.cb(frame)
+			snooped = true
+		}
+	}
+
+	if snooped && frame.dst != devSAM {
+		p.stats.fsnoop.Add(1)
+	}
+}
+
 func (p *InfinityProtocol) reader() {
 	defer panic("exiting InfinityProtocol reader, this should never happen")
 
@@ -146,12 +165,21 @@ func (p *InfinityProtocol) reader() {
 	for {
 		if p.port == nil {
 			msg = []byte{}
-			p.openSerial()
+			if err := p.openPort(); err != nil {
+				// network transports can stay down for a while; don't spin
+				log.Errorf("error opening bus interface: %s", err.Error())
+				time.Sleep(readTimeout)
+				continue
+			}
 		}
 
 		n, err := p.port.Read(buf)
 		if n == 0 || err != nil {
-			log.Printf("error reading from serial port: %s", err.Error())
+			if err == nil {
+				log.Printf("timeout reading from bus interface")
+			} else {
+				log.Printf("error reading from bus interface: %s", err.Error())
+			}
 			if p.port != nil {
 				p.port.Close()
 			}
@@ -159,7 +187,7 @@ func (p *InfinityProtocol) reader() {
 			continue
 		}
 
-		p.stats.rcvs++
+		p.stats.rcvs.Add(1)
 
 		// log.Printf("%q", buf[:n])
 		msg = append(msg, buf[:n]...)
@@ -177,17 +205,17 @@ func (p *InfinityProtocol) reader() {
 
 			frame := &InfinityFrame{}
 			if frame.decode(buf) {
-				p.stats.frames++
+				p.stats.frames.Add(1)
 				response := p.handleFrame(frame)
 				if response != nil {
-					p.stats.sresp++
+					p.stats.sresp.Add(1)
 					p.sendFrame(response.encode())
 				}
 				// Intentionally didn't do msg = msg[l:] to avoid potential
 				// memory leak.  Not sure if it makes a difference...
 				msg = msg[:copy(msg, msg[l:])]
 			} else {
-				p.stats.frerrs++
+				p.stats.frerrs.Add(1)
 				// Corrupt message, move ahead one byte and continue parsing
 				msg = msg[:copy(msg, msg[1:])]
 			}
@@ -213,7 +241,13 @@ func (p *InfinityProtocol) performAction(action *Action) {
 	// log.Infof("encoded frame: %s", action.requestFrame)
 	encodedFrame := action.requestFrame.encode()
 
-	p.stats.aact++
+	// a probe going unanswered says nothing about the health of the bus
+	stats := &p.stats
+	if action.probe {
+		stats = &protocolStats{}
+	}
+
+	stats.aact.Add(1)
 	stime := time.Now()
 
 	p.sendFrame(encodedFrame)
@@ -225,7 +259,7 @@ func (p *InfinityProtocol) performAction(action *Action) {
 			// at this point we just know it's an opRRESPONSE but could be to someone else
 			// or to us from a different thread
 			if res.src != action.requestFrame.dst {
-				p.stats.aother++
+				p.stats.aother.Add(1)
 				continue
 			}
 
@@ -233,7 +267,7 @@ func (p *InfinityProtocol) performAction(action *Action) {
 			if action.requestFrame.op == opREAD {
 				// check for a write resp coming in for a read req, can happen if the write resp was delayed and we timed out waiting for it
 				if len(res.data) < 3 {
-					p.stats.aother++
+					p.stats.aother.Add(1)
 					continue;
 				}
 
@@ -241,18 +275,21 @@ func (p *InfinityProtocol) performAction(action *Action) {
 				resTable := res.data[0:3]
 
 				if !bytes.Equal(reqTable, resTable) {
-					p.stats.aother++
+					p.stats.aother.Add(1)
 					continue
 				}
 			} else if action.requestFrame.op == opWRITE {
 				if res.dataLen != 1 || !bytes.Equal(res.data[0:1], []byte{00}) {
-					p.stats.aother++
+					p.stats.aother.Add(1)
 					continue
 				}
 			}
 
-			if tries == 0 { p.stats.aok1++ } else {p.stats.aokN++ }
-			p.stats.aokms = p.stats.aokms + time.Since(stime).Milliseconds()
+			if tries == 0 { stats.aok1.Add(1) } else {stats.aokN.Add(1) }
+			stats.aokms.Add(time.Since(stime).Milliseconds())
+			if !action.probe {
+				observeRequest(true, stime)
+			}
 
 			action.responseFrame = res
 			// log.Printf("got response!")
@@ -262,21 +299,30 @@ func (p *InfinityProtocol) performAction(action *Action) {
 			return
 		case <-ticker.C:
 			log.Debug("timeout waiting for response, retransmitting frame")
-			p.stats.aretr++
+			stats.aretr.Add(1)
 			p.sendFrame(encodedFrame)
 			tries++
 		}
 	}
 
-	log.Printf("action timed out")
-	p.stats.afailms = p.stats.afailms + time.Since(stime).Milliseconds()
-	p.stats.afail++
+	stats.afailms.Add(time.Since(stime).Milliseconds())
+	stats.afail.Add(1)
+	if action.probe {
+		log.Debug("probe timed out")
+	} else {
+		log.Printf("action timed out")
+		observeRequest(false, stime)
+	}
 	action.ch <- false
 }
 
 func (p *InfinityProtocol) send(dst uint16, op uint8, requestData []byte, response interface{}) bool {
+	return p.sendAction(dst, op, requestData, response, false)
+}
+
+func (p *InfinityProtocol) sendAction(dst uint16, op uint8, requestData []byte, response interface{}, probe bool) bool {
 	f := InfinityFrame{src: devSAM, dst: dst, op: op, data: requestData}
-	act := &Action{requestFrame: &f, ch: make(chan bool)}
+	act := &Action{requestFrame: &f, ch: make(chan bool), probe: probe}
 
 	// Send action to action handling goroutine
 	p.actionCh <- act
@@ -305,38 +351,43 @@ func (p *InfinityProtocol) Write(dst uint16, table []byte, addr []byte, params i
 	buf.Write(addr[:])
 	binary.Write(buf, binary.BigEndian, params)
 
-	p.stats.swr++
+	p.stats.swr.Add(1)
 	return p.send(dst, opWRITE, buf.Bytes(), nil)
 }
 
-func (p *InfinityProtocol) WriteTable(dst uint16, table InfinityTable, flags uint8) bool {
-	addr := table.addr()
-	fl := []byte{0x00, 0x00, flags}
-	return p.Write(dst, addr[:], fl, table)
+// Update the fields of a table selected by flags (see fieldFlags).
+func (p *InfinityProtocol) WriteTable(dst uint16, table InfinityTable, flags uint16) bool {
+	return p.WriteTableZ(dst, table, 0x00, flags)
 }
 
 // Update a table, specifying the zone index number (0 = Zone 1, 1 = Zone 2, etc).
-func (p *InfinityProtocol) WriteTableZ(dst uint16, table InfinityTable, zflag uint8, flags uint8) bool {
+// The 2nd and 3rd bytes of fl are together a 16-bit flag set, one bit per
+// field, so the ninth and higher fields in the table can be updated too.
+func (p *InfinityProtocol) WriteTableZ(dst uint16, table InfinityTable, zflag uint8, flags uint16) bool {
 	addr := table.addr()
-	fl := []byte{zflag, 0x00, flags} // not changing it now but experiments show that 2nd and 3rd bytes
-					// of fl are actually together a 16-bit flag set, which you'd need
-					// if you wanted to update the ninth or higher field in the table
+	fl := []byte{zflag, byte(flags >> 8), byte(flags)}
 	return p.Write(dst, addr[:], fl, table)
 }
 
 func (p *InfinityProtocol) Read(dst uint16, addr InfinityTableAddr, params interface{}) bool {
-	p.stats.srd++
+	p.stats.srd.Add(1)
 	return p.send(dst, opREAD, addr[:], params)
 }
 
+// like Read, for reads a device may well not answer: their failures aren't
+// counted in the stats
+func (p *InfinityProtocol) Probe(dst uint16, addr InfinityTableAddr, params interface{}) bool {
+	return p.sendAction(dst, opREAD, addr[:], params, true)
+}
+
 func (p *InfinityProtocol) ReadTable(dst uint16, table InfinityTable) bool {
 	addr := table.addr()
-	p.stats.srdt++
+	p.stats.srdt.Add(1)
 	return p.send(dst, opREAD, addr[:], table)
 }
 
 func (p *InfinityProtocol) sendFrame(buf []byte) bool {
-	// Ensure we're not in the middle of reopening the serial port due to an error.
+	// Ensure we're not in the middle of reopening the bus interface due to an error.
 	if p.port == nil {
 		return false
 	}
@@ -344,7 +395,7 @@ func (p *InfinityProtocol) sendFrame(buf []byte) bool {
 	// log.Debugf("transmitting frame: %x", buf)
 	_, err := p.port.Write(buf)
 	if err != nil {
-		log.Errorf("error writing to serial: %s", err.Error())
+		log.Errorf("error writing to bus interface: %s", err.Error())
 		p.port.Close()
 		p.port = nil
 		return false
@@ -353,25 +404,12 @@ func (p *InfinityProtocol) sendFrame(buf []byte) bool {
 }
 
 func (p *InfinityProtocol) snoopResponse(srcMin uint16, srcMax uint16, cb snoopCallback) {
-	s := InfinityProtocolSnoop{srcMin: srcMin, srcMax: srcMax, cb: cb}
+	s := InfinityProtocolSnoop{op: opRESPONSE, srcMin: srcMin, srcMax: srcMax, cb: cb}
 	p.snoops = append(p.snoops, s)
 }
 
-func (p *InfinityProtocol) getStatsString() string {
-
-	ostats := p.stats
-	p.stats = new(protocolStats)
-
-	// calculate avgs
-	if ostats.aok1 > 0 || ostats.aokN > 0 {
-		ostats.aokms = ostats.aokms / (ostats.aok1 + ostats.aokN)
-	}
-
-	if ostats.afail > 0 {
-		ostats.afailms = ostats.afailms / ostats.afail
-	}
-	ss := fmt.Sprintf("%+v", ostats)
-
-	return ss
+// like snoopResponse, but for WRITE frames sent by one device to another
+func (p *InfinityProtocol) snoopWrite(srcMin uint16, srcMax uint16, cb snoopCallback) {
+	s := InfinityProtocolSnoop{op: opWRITE, srcMin: srcMin, srcMax: srcMax, cb: cb}
+	p.snoops = append(p.snoops, s)
 }
-
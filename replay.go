@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Replay transport: plays back a resplog file written by Logger as if the
+// frames were arriving on the bus, so the snoops, caches and MQTT output can
+// be exercised offline.  Frames to or from the SAM are not replayed since
+// they belong to whoever made the log; instead the responses seen in the log
+// are remembered and used to answer our own READs, and our WRITEs are acked.
+//
+//	replay:///path/to/resplog.23101512?speed=10&loop=true
+//
+// speed is a playback rate multiplier (default 1, 0 = as fast as possible),
+// loop restarts the file from the top when it runs out.  Playback stops at
+// the end of the file otherwise, and the transport being reopened (eg after
+// a read error) carries on from where it was rather than starting again.
+type replayTransport struct {
+	path  string
+	speed float64
+	loop  bool
+
+	*frameFeed
+	*replayProgress
+}
+
+// how far playback of a file has got, kept across reopens
+type replayProgress struct {
+	playing   sync.Mutex	// held by the goroutine feeding the file
+	mu        sync.Mutex
+	offset    int64				// of the next line to play
+	responses map[string]*InfinityFrame	// last response seen per device/table
+}
+
+var replayFiles = map[string]*replayProgress{}
+var replayFilesMutex sync.Mutex
+
+func openReplayTransport(u *url.URL) (InfinityTransport, error) {
+	t := &replayTransport{
+		path:      u.Path,
+		speed:     1,
+		frameFeed: newFrameFeed(),
+	}
+
+	// allow relative paths in the form replay:resplog.23101512
+	if u.Opaque != "" {
+		t.path = u.Opaque
+	}
+
+	replayFilesMutex.Lock()
+	if replayFiles[t.path] == nil {
+		replayFiles[t.path] = &replayProgress{responses: make(map[string]*InfinityFrame)}
+	}
+	t.replayProgress = replayFiles[t.path]
+	replayFilesMutex.Unlock()
+
+	q := u.Query()
+	if s := q.Get("speed"); s != "" {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil || v < 0 {
+			return nil, fmt.Errorf("invalid replay speed '%s'", s)
+		}
+		t.speed = v
+	}
+	if s := q.Get("loop"); s != "" {
+		v, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid replay loop flag '%s'", s)
+		}
+		t.loop = v
+	}
+
+	f, err := os.Open(t.path)
+	if err != nil {
+		return nil, err
+	}
+
+	go t.feed(f)
+
+	return t, nil
+}
+
+// parse one resplog line, eg:
+//	[Oct 15 12:00:01] 2001 -> 4001: READ     000302
+func parseLogLine(line string) (time.Time, *InfinityFrame, error) {
+	if len(line) < len(time.Stamp)+2 || line[0] != '[' || line[len(time.Stamp)+1] != ']' {
+		return time.Time{}, nil, errors.New("missing timestamp")
+	}
+
+	ts, err := time.Parse(time.Stamp, line[1:len(time.Stamp)+1])
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+
+	// "2001", "->", "4001:", "READ", "000302" (data may be absent)
+	fs := strings.Fields(line[len(time.Stamp)+2:])
+	if len(fs) < 4 || fs[1] != "->" || !strings.HasSuffix(fs[2], ":") {
+		return ts, nil, errors.New("not a frame")
+	}
+
+	src, err := strconv.ParseUint(fs[0], 16, 16)
+	if err != nil {
+		return ts, nil, err
+	}
+	dst, err := strconv.ParseUint(strings.TrimSuffix(fs[2], ":"), 16, 16)
+	if err != nil {
+		return ts, nil, err
+	}
+
+	f := &InfinityFrame{src: uint16(src), dst: uint16(dst)}
+
+	switch fs[3] {
+	case "RESPONSE":
+		f.op = opRESPONSE
+	case "READ":
+		f.op = opREAD
+	case "WRITE":
+		f.op = opWRITE
+	case "ERROR":
+		f.op = opERROR
+	default:
+		var op uint64
+		if _, err := fmt.Sscanf(fs[3], "UNKNOWN(%x)", &op); err != nil {
+			return ts, nil, fmt.Errorf("unknown op '%s'", fs[3])
+		}
+		f.op = uint8(op)
+	}
+
+	f.data = []byte{}
+	if len(fs) > 4 {
+		f.data, err = hex.DecodeString(fs[4])
+		if err != nil {
+			return ts, nil, err
+		}
+	}
+	f.dataLen = uint8(len(f.data))
+
+	return ts, f, nil
+}
+
+// key for remembering the latest response from a device for a table
+func replayKey(dev uint16, table []byte) string {
+	return fmt.Sprintf("%04x/%x", dev, table)
+}
+
+func (t *replayTransport) feed(f *os.File) {
+	// wait for the feed of the transport this one replaces to stop
+	t.playing.Lock()
+	defer t.playing.Unlock()
+
+	t.mu.Lock()
+	offset := t.offset
+	t.mu.Unlock()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		log.Errorf("replay: seeking in %s: %s", t.path, err)
+		f.Close()
+		return
+	}
+
+	for {
+		if !t.play(f) {
+			f.Close()
+			return
+		}
+		f.Close()
+
+		if !t.loop {
+			log.Infof("replay: end of %s", t.path)
+			return
+		}
+
+		t.mu.Lock()
+		t.offset = 0
+		t.mu.Unlock()
+
+		var err error
+		if f, err = os.Open(t.path); err != nil {
+			log.Errorf("replay: reopening %s: %s", t.path, err)
+			return
+		}
+	}
+}
+
+// play the rest of the log file, pacing frames by their timestamps; returns
+// false if the transport was closed first
+func (t *replayTransport) play(f *os.File) bool {
+	var last time.Time
+	nl, nf := 0, 0
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			break
+		} else if err != nil && err != io.EOF {
+			log.Errorf("replay: reading %s: %s", t.path, err)
+			break
+		}
+		nl++
+
+		ts, frame, err := parseLogLine(strings.TrimRight(line, "\r\n"))
+		if err != nil {
+			log.Debugf("replay: skipping line %d: %s", nl, err)
+			t.played(line)
+			continue
+		}
+
+		// timestamps only have 1s resolution and no year, so only ever
+		// wait forward and let frames in the same second go back to back
+		if !last.IsZero() && ts.After(last) && t.speed > 0 {
+			d := time.Duration(float64(ts.Sub(last)) / t.speed)
+			select {
+			case <-time.After(d):
+			case <-t.done:
+				return false
+			}
+		}
+		last = ts
+
+		if frame.op == opRESPONSE && len(frame.data) >= 3 {
+			t.mu.Lock()
+			t.responses[replayKey(frame.src, frame.data[0:3])] = frame
+			t.mu.Unlock()
+		}
+
+		if frame.src != devSAM && frame.dst != devSAM {
+			if !t.send(frame) {
+				return false
+			}
+			nf++
+		}
+		t.played(line)
+	}
+
+	log.Infof("replay: played %d frames from %d lines", nf, nl)
+	return true
+}
+
+// move past a line that has been played
+func (t *replayTransport) played(line string) {
+	t.mu.Lock()
+	t.offset += int64(len(line))
+	t.mu.Unlock()
+}
+
+// frames we send are answered from the log rather than put on any bus
+func (t *replayTransport) Write(b []byte) (int, error) {
+	req := &InfinityFrame{}
+	if len(b) < 10 || !req.decode(b) {
+		return len(b), nil
+	}
+
+	var res *InfinityFrame
+	switch req.op {
+	case opREAD:
+		if len(req.data) >= 3 {
+			t.mu.Lock()
+			if f, ok := t.responses[replayKey(req.dst, req.data[0:3])]; ok {
+				res = &InfinityFrame{src: req.dst, dst: req.src, op: opRESPONSE, data: f.data}
+			}
+			t.mu.Unlock()
+		}
+	case opWRITE:
+		log.Debugf("replay: acking write %s", req)
+		res = &InfinityFrame{src: req.dst, dst: req.src, op: opRESPONSE, data: []byte{0x00}}
+	}
+
+	if res != nil {
+		t.reply(res)
+	}
+
+	return len(b), nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestParseLogLine(t *testing.T) {
+	tests := []struct {
+		name  string
+		line  string
+		frame *InfinityFrame
+		err   bool
+	}{
+		{"read", "[Oct 15 12:00:01] 2001 -> 4001: READ     000302",
+			&InfinityFrame{src: 0x2001, dst: 0x4001, op: opREAD, data: []byte{0x00, 0x03, 0x02}}, false},
+		{"response", "[Oct  5 08:30:59] 4001 -> 2001: RESPONSE 00030600035203",
+			&InfinityFrame{src: 0x4001, dst: 0x2001, op: opRESPONSE, data: []byte{0x00, 0x03, 0x06, 0x00, 0x03, 0x52, 0x03}}, false},
+		{"write", "[Jan  1 00:00:00] 2001 -> 9201: WRITE    003b02000010",
+			&InfinityFrame{src: 0x2001, dst: 0x9201, op: opWRITE, data: []byte{0x00, 0x3b, 0x02, 0x00, 0x00, 0x10}}, false},
+		{"error", "[Jan  1 00:00:00] 5001 -> 2001: ERROR    00",
+			&InfinityFrame{src: 0x5001, dst: 0x2001, op: opERROR, data: []byte{0x00}}, false},
+		{"unknown op", "[Jan  1 00:00:00] 5001 -> 2001: UNKNOWN(1f) 00",
+			&InfinityFrame{src: 0x5001, dst: 0x2001, op: 0x1f, data: []byte{0x00}}, false},
+		{"no data", "[Jan  1 00:00:00] 5001 -> 2001: READ",
+			&InfinityFrame{src: 0x5001, dst: 0x2001, op: opREAD, data: []byte{}}, false},
+		{"no timestamp", "2001 -> 4001: READ     000302", nil, true},
+		{"bad timestamp", "[Xyz 15 12:00:01] 2001 -> 4001: READ     000302", nil, true},
+		{"not a frame", "[Oct 15 12:00:01] resp log opened", nil, true},
+		{"bad address", "[Oct 15 12:00:01] 20x1 -> 4001: READ     000302", nil, true},
+		{"bad op", "[Oct 15 12:00:01] 2001 -> 4001: POKE     000302", nil, true},
+		{"bad data", "[Oct 15 12:00:01] 2001 -> 4001: READ     00030", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, f, err := parseLogLine(tt.line)
+			if (err != nil) != tt.err {
+				t.Fatalf("err = %v, want error %v", err, tt.err)
+			}
+			if tt.err {
+				return
+			}
+			if f.src != tt.frame.src || f.dst != tt.frame.dst || f.op != tt.frame.op || !bytes.Equal(f.data, tt.frame.data) ||
+				int(f.dataLen) != len(tt.frame.data) {
+				t.Errorf("got %s, want %s", f, tt.frame)
+			}
+		})
+	}
+}
+
+// what Logger writes can be read back
+func TestParseLogLineRoundTrip(t *testing.T) {
+	ts := time.Date(0, time.March, 7, 9, 5, 3, 0, time.UTC)
+	f := &InfinityFrame{src: 0x2001, dst: 0x6001, op: opWRITE, data: []byte{0x00, 0x03, 0x19, 0xff}}
+
+	gotTs, got, err := parseLogLine("[" + ts.Format(time.Stamp) + "] " + f.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gotTs.Equal(ts) {
+		t.Errorf("time %v, want %v", gotTs, ts)
+	}
+	if got.String() != f.String() {
+		t.Errorf("got %s, want %s", got, f)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// telnet protocol bytes
+const (
+	telIAC  = byte(255)
+	telDONT = byte(254)
+	telDO   = byte(253)
+	telWONT = byte(252)
+	telWILL = byte(251)
+	telSB   = byte(250)
+	telSE   = byte(240)
+
+	telOptBinary  = byte(0)
+	telOptSGA     = byte(3)
+	telOptComPort = byte(44)
+)
+
+// RFC2217 COM-PORT-OPTION client commands
+const (
+	cpoSetBaudRate = byte(1)
+	cpoSetDataSize = byte(2)
+	cpoSetParity   = byte(3)
+	cpoSetStopSize = byte(4)
+	cpoSetControl  = byte(5)
+)
+
+// states of the telnet receive parser
+const (
+	telStateData = iota
+	telStateIAC
+	telStateOpt
+	telStateSB
+	telStateSBIAC
+)
+
+// RFC2217 transport: a telnet session to a serial bridge, which lets us set
+// the remote port to 38400 8N1 and carries bus data with 0xff escaped
+type rfc2217Transport struct {
+	conn  net.Conn
+	state int
+	cmd   byte
+	buf   []byte
+}
+
+func openRFC2217Transport(addr string) (InfinityTransport, error) {
+	conn, err := net.DialTimeout("tcp", addr, readTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &rfc2217Transport{conn: conn, buf: make([]byte, 1024)}
+
+	var b bytes.Buffer
+	b.Write([]byte{telIAC, telWILL, telOptBinary, telIAC, telDO, telOptBinary})
+	b.Write([]byte{telIAC, telWILL, telOptSGA, telIAC, telDO, telOptSGA})
+	b.Write([]byte{telIAC, telWILL, telOptComPort})
+
+	baud := make([]byte, 4)
+	binary.BigEndian.PutUint32(baud, 38400)
+	t.subneg(&b, cpoSetBaudRate, baud...)
+	t.subneg(&b, cpoSetDataSize, 8)
+	t.subneg(&b, cpoSetParity, 1)	// none
+	t.subneg(&b, cpoSetStopSize, 1)	// 1 stop bit
+	t.subneg(&b, cpoSetControl, 1)	// no flow control
+
+	conn.SetWriteDeadline(time.Now().Add(readTimeout))
+	if _, err := conn.Write(b.Bytes()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// append a COM-PORT-OPTION subnegotiation to b
+func (t *rfc2217Transport) subneg(b *bytes.Buffer, cmd byte, val ...byte) {
+	b.Write([]byte{telIAC, telSB, telOptComPort, cmd})
+	b.Write(telEscape(val))
+	b.Write([]byte{telIAC, telSE})
+}
+
+// double any IAC bytes so they pass through as data
+func telEscape(data []byte) []byte {
+	return bytes.ReplaceAll(data, []byte{telIAC}, []byte{telIAC, telIAC})
+}
+
+func (t *rfc2217Transport) Read(b []byte) (int, error) {
+	for {
+		t.conn.SetReadDeadline(time.Now().Add(readTimeout))
+		// filtered data is never longer than what was read, so read no
+		// more than the caller can take
+		if cap(t.buf) < len(b) {
+			t.buf = make([]byte, len(b))
+		}
+		n, err := t.conn.Read(t.buf[:len(b)])
+		if err != nil {
+			return 0, err
+		}
+
+		// strip the telnet protocol out of what we got; if it was all
+		// protocol, go around again rather than returning an empty read
+		// which would look like a timeout to the bus reader
+		nd := t.filter(t.buf[:n], b)
+		if nd > 0 {
+			return nd, nil
+		}
+	}
+}
+
+// run received bytes through the telnet parser, copying bus data to out
+// and answering option negotiation; returns the number of data bytes
+func (t *rfc2217Transport) filter(in []byte, out []byte) int {
+	n := 0
+	for _, c := range in {
+		switch t.state {
+		case telStateData:
+			if c == telIAC {
+				t.state = telStateIAC
+			} else {
+				out[n] = c
+				n++
+			}
+		case telStateIAC:
+			switch c {
+			case telIAC:
+				out[n] = c
+				n++
+				t.state = telStateData
+			case telDO, telDONT, telWILL, telWONT:
+				t.cmd = c
+				t.state = telStateOpt
+			case telSB:
+				t.state = telStateSB
+			default:
+				t.state = telStateData
+			}
+		case telStateOpt:
+			t.negotiate(t.cmd, c)
+			t.state = telStateData
+		case telStateSB:
+			// COM-PORT-OPTION notifications from the server are ignored
+			if c == telIAC {
+				t.state = telStateSBIAC
+			}
+		case telStateSBIAC:
+			if c == telSE {
+				t.state = telStateData
+			} else {
+				t.state = telStateSB
+			}
+		}
+	}
+	return n
+}
+
+// refuse any option we did not ask for; the ones we asked for need no reply
+func (t *rfc2217Transport) negotiate(cmd byte, opt byte) {
+	if opt == telOptBinary || opt == telOptSGA || opt == telOptComPort {
+		if cmd == telWONT || cmd == telDONT {
+			log.Warnf("rfc2217: server refused telnet option %d", opt)
+		}
+		return
+	}
+
+	switch cmd {
+	case telDO:
+		t.conn.Write([]byte{telIAC, telWONT, opt})
+	case telWILL:
+		t.conn.Write([]byte{telIAC, telDONT, opt})
+	}
+}
+
+func (t *rfc2217Transport) Write(b []byte) (int, error) {
+	t.conn.SetWriteDeadline(time.Now().Add(readTimeout))
+	_, err := t.conn.Write(telEscape(b))
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (t *rfc2217Transport) Close() error {
+	return t.conn.Close()
+}
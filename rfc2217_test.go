@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestTelnetFilter(t *testing.T) {
+	tests := []struct {
+		name  string
+		in    [][]byte	// as read, in pieces
+		want  []byte
+		state int	// after the last piece
+	}{
+		{"plain data", [][]byte{{0x20, 0x01, 0x00}}, []byte{0x20, 0x01, 0x00}, telStateData},
+		{"escaped IAC", [][]byte{{0x01, telIAC, telIAC, 0x02}}, []byte{0x01, 0xff, 0x02}, telStateData},
+		{"IAC split across reads", [][]byte{{0x01, telIAC}, {telIAC, 0x02}}, []byte{0x01, 0xff, 0x02}, telStateData},
+		{"option reply", [][]byte{{0x01, telIAC, telWILL, telOptBinary, 0x02}}, []byte{0x01, 0x02}, telStateData},
+		{"option split across reads", [][]byte{{telIAC, telDO}, {telOptSGA, 0x03}}, []byte{0x03}, telStateData},
+		{"subnegotiation", [][]byte{{0x01, telIAC, telSB, telOptComPort, 101, 0x00, 0x96, 0x00, telIAC, telSE, 0x02}},
+			[]byte{0x01, 0x02}, telStateData},
+		{"IAC in subnegotiation", [][]byte{{telIAC, telSB, telOptComPort, telIAC, telIAC, 0x07, telIAC, telSE, 0x04}},
+			[]byte{0x04}, telStateData},
+		{"subnegotiation unfinished", [][]byte{{0x01, telIAC, telSB, telOptComPort, 0x07}}, []byte{0x01}, telStateSB},
+		{"other command", [][]byte{{0x01, telIAC, 241, 0x02}}, []byte{0x01, 0x02}, telStateData},
+		{"only protocol", [][]byte{{telIAC, telWILL, telOptComPort}}, []byte{}, telStateData},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := &rfc2217Transport{}
+			got := []byte{}
+			for _, in := range tt.in {
+				out := make([]byte, len(in))
+				n := tr.filter(in, out)
+				got = append(got, out[:n]...)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("got %x, want %x", got, tt.want)
+			}
+			if tr.state != tt.state {
+				t.Errorf("state %d, want %d", tr.state, tt.state)
+			}
+		})
+	}
+}
+
+// options we didn't ask for are refused
+func TestTelnetRefuse(t *testing.T) {
+	tests := []struct {
+		name string
+		cmd  byte
+		want []byte
+	}{
+		{"DO", telDO, []byte{telIAC, telWONT, 24}},
+		{"WILL", telWILL, []byte{telIAC, telDONT, 24}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			got := make(chan []byte)
+			go func() {
+				b := make([]byte, 3)
+				n, _ := server.Read(b)
+				got <- b[:n]
+			}()
+
+			tr := &rfc2217Transport{conn: client}
+			out := make([]byte, 4)
+			if n := tr.filter([]byte{telIAC, tt.cmd, 24, 0x05}, out); n != 1 || out[0] != 0x05 {
+				t.Errorf("data %x", out[:n])
+			}
+			if b := <-got; !bytes.Equal(b, tt.want) {
+				t.Errorf("reply %x, want %x", b, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Runtime accounting: how long each stage of the equipment has run, and how
+// many times it has started, in total and per (local) day, worked out from
+// the air handler and heat pump data snooped off the bus.  The counts are
+// saved to a file every minute so they survive a restart.
+
+var runtimeStages = []struct {
+	id, name string
+}{
+	{ "heat1", "Heat Stage 1" },
+	{ "heat2", "Heat Stage 2" },
+	{ "heat3", "Heat Stage 3" },
+	{ "cool1", "Cool Stage 1" },
+	{ "cool2", "Cool Stage 2" },
+	{ "elecHeat", "Electric Heat" },
+	{ "fanOnly", "Fan Only" },
+}
+
+type stageCount struct {
+	Seconds float64 `json:"seconds"`
+	Cycles  int64   `json:"cycles"`
+}
+
+type stageCounts map[string]*stageCount
+
+func (sc stageCounts) get(id string) *stageCount {
+	c := sc[id]
+	if c == nil {
+		c = &stageCount{}
+		sc[id] = c
+	}
+	return c
+}
+
+// what is saved to the runtime file
+type runtimeState struct {
+	Since time.Time              `json:"since"`
+	Total stageCounts            `json:"total"`
+	Days  map[string]stageCounts `json:"days"`	// by local date, 2006-01-02
+}
+
+const runtimeDaysKept = 92
+
+// a run shorter than this isn't counted as a cycle, eg the blower running on
+// for a moment after heating stops
+const runtimeMinRun = 10 * time.Second
+
+type stageRun struct {
+	start   time.Time
+	counted bool
+}
+
+var runtimeCounts = runtimeState{Since: time.Now(), Total: stageCounts{}, Days: map[string]stageCounts{}}
+var runtimeFile string
+var runtimeRuns = map[string]*stageRun{}	// the stages running now
+var runtimeLast time.Time	// when the counts were last brought up to date
+var runtimeChanged bool
+var runtimeMutex sync.Mutex
+
+// load the counts saved in file, and save them there from now on
+func openRuntime(file string) error {
+	runtimeMutex.Lock()
+	defer runtimeMutex.Unlock()
+
+	runtimeFile = file
+	b, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var rs runtimeState
+	if err := json.Unmarshal(b, &rs); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	if rs.Total == nil {
+		rs.Total = stageCounts{}
+	}
+	if rs.Days == nil {
+		rs.Days = map[string]stageCounts{}
+	}
+	runtimeCounts = rs
+	return nil
+}
+
+// the stages running according to the air handler and heat pump
+func activeStages(ah AirHandler, hp HeatPump) map[string]bool {
+	a := map[string]bool{}
+	if ah.Action == "heating" && ah.HeatStage >= 1 && ah.HeatStage <= 3 {
+		a[fmt.Sprintf("heat%d", ah.HeatStage)] = true
+	}
+	if ah.Action == "cooling" && hp.Stage >= 1 && hp.Stage <= 2 {
+		a[fmt.Sprintf("cool%d", hp.Stage)] = true
+	}
+	// on a fan coil, alongside its heat stage
+	if ah.ElecHeat {
+		a["elecHeat"] = true
+	}
+	// this includes the blower running on for a while after heating or
+	// cooling stops, which can't be told apart from the fan being left on
+	if ah.Action == "idle" && ah.BlowerRPM > 0 {
+		a["fanOnly"] = true
+	}
+	return a
+}
+
+// the counts for the day of t; runtimeMutex must be held
+func runtimeDay(t time.Time) stageCounts {
+	day := t.Format("2006-01-02")
+	if runtimeCounts.Days[day] == nil {
+		runtimeCounts.Days[day] = stageCounts{}
+	}
+	return runtimeCounts.Days[day]
+}
+
+// add the time since the last update to the stages that were running;
+// runtimeMutex must be held
+func accrueRuntime(now time.Time) {
+	last := runtimeLast
+	runtimeLast = now
+
+	// no data for a while: don't guess what ran
+	if last.IsZero() || now.Sub(subsystemLastSeen("airhandler")) >= staleTime {
+		return
+	}
+	d := now.Sub(last)
+
+	for id := range runtimeRuns {
+		runtimeCounts.Total.get(id).Seconds += d.Seconds()
+		runtimeDay(now).get(id).Seconds += d.Seconds()
+		runtimeChanged = true
+	}
+}
+
+// called from the snoops when the air handler or heat pump data changes
+func noteRuntime() {
+	ah, ok1 := getAirHandler()
+	hp, ok2 := getHeatPump()
+	if !ok1 || !ok2 {
+		return
+	}
+	active := activeStages(ah, hp)
+
+	runtimeMutex.Lock()
+	defer runtimeMutex.Unlock()
+
+	now := time.Now()
+	accrueRuntime(now)
+
+	for id := range active {
+		if runtimeRuns[id] == nil {
+			log.Debugf("runtime: %s started", id)
+			runtimeRuns[id] = &stageRun{start: now}
+		}
+	}
+	for id := range runtimeRuns {
+		if !active[id] {
+			log.Debugf("runtime: %s stopped", id)
+			delete(runtimeRuns, id)
+		}
+	}
+	countCycles(now)
+	noteCalls(active, now)
+}
+
+// the stages running now, and since when
+func runningStages() map[string]time.Time {
+	runtimeMutex.Lock()
+	defer runtimeMutex.Unlock()
+
+	runs := map[string]time.Time{}
+	for id, run := range runtimeRuns {
+		runs[id] = run.start
+	}
+	return runs
+}
+
+// count the runs that have gone on long enough as cycles, on the day they
+// started; runtimeMutex must be held
+func countCycles(now time.Time) {
+	for id, run := range runtimeRuns {
+		if !run.counted && now.Sub(run.start) >= runtimeMinRun {
+			runtimeCounts.Total.get(id).Cycles++
+			runtimeDay(run.start).get(id).Cycles++
+			run.counted = true
+			runtimeChanged = true
+		}
+	}
+}
+
+// write the counts out if they've changed; runtimeMutex must be held
+func saveRuntime() {
+	if runtimeFile == "" || !runtimeChanged {
+		return
+	}
+
+	b, err := json.MarshalIndent(&runtimeCounts, "", "  ")
+	if err == nil {
+		// via a temporary file so a crash can't leave half a file
+		tmp := runtimeFile + ".tmp"
+		err = os.WriteFile(tmp, b, 0644)
+		if err == nil {
+			err = os.Rename(tmp, runtimeFile)
+		}
+	}
+	if err != nil {
+		log.Errorf("runtime: saving %s: %s", runtimeFile, err)
+		return
+	}
+	runtimeChanged = false
+}
+
+type runtimeRollup struct {
+	Start  time.Time              `json:"start"`	// of the day or week
+	Stages map[string]stageCount  `json:"stages"`
+}
+
+type runtimeReport struct {
+	Since time.Time             `json:"since"`
+	Total map[string]stageCount `json:"total"`
+	Days  []runtimeRollup       `json:"days"`	// newest first
+	Weeks []runtimeRollup       `json:"weeks"`	// starting Mondays, newest first
+}
+
+// the counts of every stage, with those missing as zero
+func rollupStages(from ...stageCounts) map[string]stageCount {
+	r := map[string]stageCount{}
+	for _, s := range runtimeStages {
+		var c stageCount
+		for _, sc := range from {
+			if v := sc[s.id]; v != nil {
+				c.Seconds += v.Seconds
+				c.Cycles += v.Cycles
+			}
+		}
+		c.Seconds = math.Round(c.Seconds)
+		r[s.id] = c
+	}
+	return r
+}
+
+// the totals, and the last n days and weeks including the current ones
+func getRuntime(days, weeks int) *runtimeReport {
+	runtimeMutex.Lock()
+	defer runtimeMutex.Unlock()
+
+	accrueRuntime(time.Now())
+
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	r := &runtimeReport{Since: runtimeCounts.Since, Total: rollupStages(runtimeCounts.Total),
+		Days: []runtimeRollup{}, Weeks: []runtimeRollup{}}
+
+	for i := 0; i < days; i++ {
+		d := today.AddDate(0, 0, -i)
+		r.Days = append(r.Days, runtimeRollup{d, rollupStages(runtimeCounts.Days[d.Format("2006-01-02")])})
+	}
+
+	monday := today.AddDate(0, 0, -(int(today.Weekday()) + 6) % 7)
+	for i := 0; i < weeks; i++ {
+		w := monday.AddDate(0, 0, -7 * i)
+		var week []stageCounts
+		for j := 0; j < 7; j++ {
+			week = append(week, runtimeCounts.Days[w.AddDate(0, 0, j).Format("2006-01-02")])
+		}
+		r.Weeks = append(r.Weeks, runtimeRollup{w, rollupStages(week...)})
+	}
+	return r
+}
+
+// keep the counts up to date while nothing changes, publish them, and save
+// them and drop old days every minute
+func runtimeMonitor() {
+	for {
+		time.Sleep(time.Minute)
+
+		runtimeMutex.Lock()
+		now := time.Now()
+		accrueRuntime(now)
+		countCycles(now)
+
+		oldest := now.AddDate(0, 0, -runtimeDaysKept).Format("2006-01-02")
+		for day := range runtimeCounts.Days {
+			if day < oldest {
+				delete(runtimeCounts.Days, day)
+				runtimeChanged = true
+			}
+		}
+		saveRuntime()
+		runtimeMutex.Unlock()
+
+		r := getRuntime(1, 1)
+		for _, s := range runtimeStages {
+			p := "mqtt/runtime/" + s.id
+			mqttCache.update(p+"/today", math.Round(r.Days[0].Stages[s.id].Seconds / 36) / 100)
+			mqttCache.update(p+"/cyclesToday", r.Days[0].Stages[s.id].Cycles)
+			mqttCache.update(p+"/total", math.Round(r.Total[s.id].Seconds / 36) / 100)
+			mqttCache.update(p+"/cycles", r.Total[s.id].Cycles)
+		}
+		wsCache.update("runtime", r)
+	}
+}
+
+// a sensor that only goes up (or resets, for the daily ones), for HA's
+// long term statistics
+type counterDiscovery struct {
+	discoveryConfig
+	State_class string `json:"state_class"`
+}
+
+// publish HA sensors for the runtime and cycle counts of each stage
+func publishRuntimeDiscovery(cl mqtt.Client) {
+	for _, s := range runtimeStages {
+		p := "runtime/" + s.id
+		id := "hvac-runtime-" + s.id
+		for _, dt := range []discoveryTopic{
+			{ p+"/today", "HVAC "+s.name+" Runtime Today", "duration", "h", id+"-today" },
+			{ p+"/total", "HVAC "+s.name+" Runtime", "duration", "h", id+"-total" },
+			{ p+"/cyclesToday", "HVAC "+s.name+" Cycles Today", "", "", id+"-cycles-today" },
+			{ p+"/cycles", "HVAC "+s.name+" Cycles", "", "", id+"-cycles" },
+		} {
+			dt := dt
+			dt.Topic = mqttTopic(dt.Topic)
+			dt.Unique_id = mqttUniqueID(dt.Unique_id)
+
+			// counted by infinitive itself, so only its own availability matters
+			cd := counterDiscovery{discoveryConfig{&dt, []availabilityEntry{ { availabilityTopic() } }, "all", mqttDevice()}, "total_increasing"}
+			j, err := json.Marshal(&cd)
+			if err == nil {
+				_ = cl.Publish("homeassistant/sensor/infinitive/" + dt.Unique_id + "/config", 0, true, j)
+			}
+		}
+	}
+}
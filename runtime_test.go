@@ -0,0 +1,160 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func resetRuntime() {
+	runtimeCounts = runtimeState{Total: stageCounts{}, Days: map[string]stageCounts{}}
+	runtimeRuns = map[string]*stageRun{}
+	runtimeLast = time.Time{}
+	runtimeChanged = false
+	runtimeFile = ""
+}
+
+func TestActiveStages(t *testing.T) {
+	tests := []struct {
+		name string
+		ah   AirHandler
+		hp   HeatPump
+		want map[string]bool
+	}{
+		{"idle", AirHandler{Action: "idle"}, HeatPump{}, map[string]bool{}},
+		{"heat stage 2", AirHandler{Action: "heating", HeatStage: 2, BlowerRPM: 900}, HeatPump{}, map[string]bool{"heat2": true}},
+		{"fan coil heat stage 1", AirHandler{Action: "heating", HeatStage: 1, ElecHeat: true, BlowerRPM: 800}, HeatPump{},
+			map[string]bool{"heat1": true, "elecHeat": true}},
+		{"heating with no stage", AirHandler{Action: "heating"}, HeatPump{}, map[string]bool{}},
+		{"cool stage 1", AirHandler{Action: "cooling", BlowerRPM: 700}, HeatPump{Stage: 1}, map[string]bool{"cool1": true}},
+		{"outdoor stage while not cooling", AirHandler{Action: "idle"}, HeatPump{Stage: 2}, map[string]bool{}},
+		{"fan only", AirHandler{Action: "idle", BlowerRPM: 400}, HeatPump{}, map[string]bool{"fanOnly": true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := activeStages(tt.ah, tt.hp); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCountCycles(t *testing.T) {
+	resetRuntime()
+	defer resetRuntime()
+
+	now := time.Date(2024, 1, 9, 0, 0, 5, 0, time.Local)
+	runtimeRuns = map[string]*stageRun{
+		"heat1":   { start: now.Add(-15 * time.Second) },	// started the day before
+		"fanOnly": { start: now.Add(-5 * time.Second) },	// too short so far
+		"cool1":   { start: now.Add(-time.Hour), counted: true },
+	}
+
+	tests := []struct {
+		name  string
+		now   time.Time
+		total map[string]int64
+		days  map[string]map[string]int64
+	}{
+		{"first", now, map[string]int64{"heat1": 1},
+			map[string]map[string]int64{"2024-01-08": {"heat1": 1}}},
+		{"again", now, map[string]int64{"heat1": 1},
+			map[string]map[string]int64{"2024-01-08": {"heat1": 1}}},
+		{"later", now.Add(10 * time.Second), map[string]int64{"heat1": 1, "fanOnly": 1},
+			map[string]map[string]int64{"2024-01-08": {"heat1": 1}, "2024-01-09": {"fanOnly": 1}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			countCycles(tt.now)
+
+			total := map[string]int64{}
+			for id, c := range runtimeCounts.Total {
+				total[id] = c.Cycles
+			}
+			days := map[string]map[string]int64{}
+			for day, sc := range runtimeCounts.Days {
+				days[day] = map[string]int64{}
+				for id, c := range sc {
+					days[day][id] = c.Cycles
+				}
+			}
+			if !reflect.DeepEqual(total, tt.total) {
+				t.Errorf("total %v, want %v", total, tt.total)
+			}
+			if !reflect.DeepEqual(days, tt.days) {
+				t.Errorf("days %v, want %v", days, tt.days)
+			}
+		})
+	}
+}
+
+func TestGetRuntime(t *testing.T) {
+	resetRuntime()
+	defer resetRuntime()
+
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	monday := today.AddDate(0, 0, -(int(today.Weekday()) + 6) % 7)
+	// today may be the Monday
+	add := func(d time.Time, id string, secs float64, cycles int64) {
+		c := runtimeDay(d).get(id)
+		c.Seconds += secs
+		c.Cycles += cycles
+	}
+
+	runtimeCounts.Total = stageCounts{"heat1": {Seconds: 9000.4, Cycles: 30}, "fanOnly": {Seconds: 60, Cycles: 2}}
+	add(today, "fanOnly", 60, 2)
+	add(monday, "heat1", 1000, 3)
+	add(monday.AddDate(0, 0, -1), "heat1", 2000, 4)
+	add(monday.AddDate(0, 0, -7), "heat1", 3000, 5)
+	add(monday.AddDate(0, 0, -7), "cool1", 100, 1)
+	add(monday.AddDate(0, 0, -8), "heat1", 4000, 6)
+
+	r := getRuntime(3, 3)
+
+	tests := []struct {
+		name  string
+		got   runtimeRollup
+		start time.Time
+		want  map[string]stageCount
+	}{
+		{"today", r.Days[0], today, nil},
+		{"this week", r.Weeks[0], monday, map[string]stageCount{"heat1": {1000, 3}}},
+		{"last week", r.Weeks[1], monday.AddDate(0, 0, -7), map[string]stageCount{"heat1": {5000, 9}, "cool1": {100, 1}}},
+		{"the week before", r.Weeks[2], monday.AddDate(0, 0, -14), map[string]stageCount{"heat1": {4000, 6}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !tt.got.Start.Equal(tt.start) {
+				t.Errorf("start %v, want %v", tt.got.Start, tt.start)
+			}
+			if len(tt.got.Stages) != len(runtimeStages) {
+				t.Errorf("%d stages, want %d", len(tt.got.Stages), len(runtimeStages))
+			}
+			for id, c := range tt.want {
+				if tt.got.Stages[id] != c {
+					t.Errorf("%s %v, want %v", id, tt.got.Stages[id], c)
+				}
+			}
+		})
+	}
+
+	if len(r.Days) != 3 || len(r.Weeks) != 3 {
+		t.Errorf("%d days and %d weeks, want 3 and 3", len(r.Days), len(r.Weeks))
+	}
+	if c := r.Days[0].Stages["fanOnly"]; c != (stageCount{60, 2}) {
+		t.Errorf("today fanOnly %v", c)
+	}
+	if c := r.Weeks[0].Stages["fanOnly"]; c != (stageCount{60, 2}) {
+		t.Errorf("this week fanOnly %v", c)
+	}
+	if c := r.Total["heat1"]; c != (stageCount{9000, 30}) {
+		t.Errorf("total heat1 %v, rounded to the second", c)
+	}
+	if c := r.Total["cool2"]; c != (stageCount{}) {
+		t.Errorf("total cool2 %v, want zero", c)
+	}
+}
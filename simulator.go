@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/url"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// device addresses used by the simulated equipment
+const (
+	simAirHandler = uint16(0x4001)
+	simHeatPump   = uint16(0x5001)
+	simDampers    = uint16(0x6001)
+)
+
+// Simulated Infinity system: a thermostat with up to 4 zones on one damper
+// controller, an air handler with furnace and an outdoor AC unit.  The
+// thermostat answers our READs and WRITEs of the 3b02, 3b03, 3b04 and 3b06
+// tables, the 3b07-3b0d schedules and 3d02/3d03 actuals, and polls the other
+// equipment once per tick, so everything that infinitive normally snoops is
+// on the "bus" too.  Zone temperatures follow the modes and setpoints
+// written to it.
+//
+//	sim://?zones=2&outdoor=40&speed=10
+//
+// zones is the number of zones (1-4, default 2), outdoor the outdoor temp in
+// degF (default 50) and speed a multiplier on how fast temps change (default 1).
+type simTransport struct {
+	*frameFeed
+
+	mu       sync.Mutex
+	speed    float64
+	outdoor  float64
+	temps    [8]float64
+	coilTemp float64
+	demand   [8]int	// per zone: 1 = calling for heat, -1 = calling for cool
+	stage    uint8	// current stage of heating or cooling (0 = idle)
+	heating  bool
+	cooling  bool
+
+	current  TStatCurrentParams
+	zone     TStatZoneParams
+	vacation TStatVacationParams
+	settings TStatSettings
+	schedule [7]TStatDaySchedule
+	temps16  TStatZoneTemps
+	actuals  TStatActuals
+}
+
+func openSimTransport(u *url.URL) (InfinityTransport, error) {
+	t := &simTransport{frameFeed: newFrameFeed(), speed: 1, outdoor: 50}
+
+	zones := 2
+	q := u.Query()
+	if s := q.Get("zones"); s != "" {
+		v, err := strconv.Atoi(s)
+		if err != nil || v < 1 || v > 4 {
+			return nil, fmt.Errorf("invalid simulator zone count '%s'", s)
+		}
+		zones = v
+	}
+	if s := q.Get("outdoor"); s != "" {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid simulator outdoor temp '%s'", s)
+		}
+		t.outdoor = v
+	}
+	if s := q.Get("speed"); s != "" {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil || v <= 0 {
+			return nil, fmt.Errorf("invalid simulator speed '%s'", s)
+		}
+		t.speed = v
+	}
+
+	t.init(zones)
+	go t.run()
+
+	return t, nil
+}
+
+// set up a plausible starting state
+func (t *simTransport) init(zones int) {
+	for zi := 0; zi < 8; zi++ {
+		if zi < zones {
+			t.temps[zi] = 68 + float64(zi)
+			t.zone.ZHeatSetpoint[zi] = 68
+			t.zone.ZCoolSetpoint[zi] = 76
+			t.zone.ZTargetHumidity[zi] = 45
+			copy(t.zone.ZName[zi][:], fmt.Sprintf("%-12s", fmt.Sprintf("Zone %d", zi+1)))
+		} else {
+			copy(t.zone.ZName[zi][:], fmt.Sprintf("%-12s", ""))
+		}
+	}
+	t.coilTemp = t.outdoor
+	t.temps16.Unknown = 0xa5
+	t.current.Mode, _ = stringModeToRaw("auto")
+
+	t.vacation.MinTemperature = 60
+	t.vacation.MaxTemperature = 85
+	t.vacation.MinHumidity = 15
+	t.vacation.MaxHumidity = 60
+
+	t.settings.BacklightSetting = 5
+	t.settings.AutoMode = 1
+	t.settings.DeadBand = 2
+	t.settings.CyclesPerHour = 4
+	t.settings.SchedulePeriods = 4
+	copy(t.settings.DealerName[:], "Simulated Dealer")
+	copy(t.settings.DealerPhone[:], "555-0100")
+
+	// the same program every day: wake at 6:30, day at 8, evening at 17, sleep at 22
+	for day := range t.schedule {
+		for zi := 0; zi < zones; zi++ {
+			t.schedule[day].Zones[zi] = [4]TStatSchedulePeriod{
+				{6*60 + 30, 68, 76, 0xff}, {8 * 60, 62, 80, 0xff},
+				{17 * 60, 68, 76, 0xff}, {22 * 60, 64, 78, 0xff},
+			}
+		}
+	}
+
+	t.update(0)
+}
+
+func (t *simTransport) run() {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+		case <-t.done:
+			return
+		}
+
+		t.mu.Lock()
+		t.update(t.speed)
+		frames := t.equipmentTraffic()
+		t.mu.Unlock()
+
+		for _, f := range frames {
+			if !t.send(f) {
+				return
+			}
+		}
+	}
+}
+
+// active heat and cool setpoints for a zone, honoring vacation mode
+func (t *simTransport) setpoints(zi int) (float64, float64) {
+	if t.vacation.Active == 1 {
+		return float64(t.vacation.MinTemperature), float64(t.vacation.MaxTemperature)
+	}
+	return float64(t.zone.ZHeatSetpoint[zi]), float64(t.zone.ZCoolSetpoint[zi])
+}
+
+// advance the simulation by one tick of dt (scaled) seconds
+func (t *simTransport) update(dt float64) {
+	mode := rawModeToString(t.current.Mode & 0x0f)
+	canHeat := mode == "heat" || mode == "auto" || mode == "electric" || mode == "heatpump"
+	canCool := mode == "cool" || mode == "auto"
+
+	// each zone calls for heat or cool with a degree of hysteresis
+	t.heating, t.cooling = false, false
+	maxErr := 0.0
+	for zi := range t.demand {
+		if t.temps[zi] == 0 {
+			continue
+		}
+		heatSP, coolSP := t.setpoints(zi)
+
+		switch {
+		case canHeat && t.temps[zi] < heatSP-0.5:
+			t.demand[zi] = 1
+		case canCool && t.temps[zi] > coolSP+0.5:
+			t.demand[zi] = -1
+		case t.demand[zi] == 1 && (!canHeat || t.temps[zi] >= heatSP+0.5):
+			t.demand[zi] = 0
+		case t.demand[zi] == -1 && (!canCool || t.temps[zi] <= coolSP-0.5):
+			t.demand[zi] = 0
+		}
+
+		switch t.demand[zi] {
+		case 1:
+			t.heating = true
+			maxErr = math.Max(maxErr, heatSP-t.temps[zi])
+		case -1:
+			t.cooling = true
+			maxErr = math.Max(maxErr, t.temps[zi]-coolSP)
+		}
+	}
+
+	// heating wins if zones disagree
+	if t.heating {
+		t.cooling = false
+	}
+
+	t.stage = 0
+	if t.heating || t.cooling {
+		t.stage = 1
+		if maxErr > 2 {
+			t.stage = 2
+		}
+	}
+
+	// zones being served move toward their setpoint, everything else
+	// drifts slowly toward the outdoor temp
+	for zi := range t.temps {
+		if t.temps[zi] == 0 {
+			continue
+		}
+		switch {
+		case t.heating && t.demand[zi] == 1:
+			t.temps[zi] += 0.01 * float64(t.stage) * dt
+		case t.cooling && t.demand[zi] == -1:
+			t.temps[zi] -= 0.008 * float64(t.stage) * dt
+		default:
+			t.temps[zi] += (t.outdoor - t.temps[zi]) * 0.0001 * dt
+		}
+		t.current.ZCurrentTemp[zi] = uint8(math.Round(t.temps[zi]))
+		t.current.ZCurrentHumidity[zi] = 45
+
+		// thermostat in zone 1, smart sensors elsewhere
+		t.temps16.Zones[zi].Flags = 0x0104
+		if zi == 0 {
+			t.temps16.Zones[zi].Flags = 0x0101
+		}
+		t.temps16.Zones[zi].RawTemp = int16(math.Round(t.temps[zi] * 16))
+		t.temps16.Zones[zi].Temp = t.current.ZCurrentTemp[zi]
+	}
+
+	// the coil chills down while the compressor runs
+	target := t.outdoor
+	if t.cooling {
+		target = 40
+	}
+	t.coilTemp += (target - t.coilTemp) * math.Min(1, 0.02*dt)
+
+	t.current.OutdoorAirTemp = uint8(math.Max(0, math.Min(255, math.Round(t.outdoor))))
+	t.actuals.OutdoorTemp = int16(math.Round(t.outdoor * 16))
+	t.actuals.Humidity = 45
+	t.actuals.RawHumidity = 46
+
+	// action bits are chosen so rawActionToString() reports the right thing
+	action := uint8(0)
+	if t.cooling {
+		action = t.stage
+	} else if t.heating {
+		action = 2 + t.stage
+	}
+	t.current.Mode = (t.current.Mode & 0x0f) | action<<5
+}
+
+// one poll cycle of the equipment by the thermostat, as READs and RESPONSEs
+func (t *simTransport) equipmentTraffic() []*InfinityFrame {
+	running := t.heating || t.cooling
+	fanOn := running
+	for zi := range t.zone.ZFanMode {
+		if t.temps[zi] != 0 && t.zone.ZFanMode[zi] != 0 {
+			fanOn = true
+		}
+	}
+
+	rpm := uint16(0)
+	if running {
+		rpm = 600 + 250*uint16(t.stage)
+	} else if fanOn {
+		rpm = 500
+	}
+	cfm := rpm * 4 / 5
+	sp := 0.0
+	if rpm > 0 {
+		sp = 0.2 + float64(rpm)/4000
+	}
+
+	heatStage := uint8(0)
+	coolFlag := uint8(0)
+	if t.heating {
+		heatStage = t.stage
+	}
+	if t.cooling {
+		coolFlag = 0x02
+	}
+
+	// table 0306: blower RPM
+	ah306 := []byte{0x00, 0x03, 0x06, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	binary.BigEndian.PutUint16(ah306[4:6], rpm)
+
+	// table 0316: heat stage, cool flag, CFM, static pressure
+	ah316 := make([]byte, 3+14)
+	copy(ah316, []byte{0x00, 0x03, 0x16})
+	ah316[3] = heatStage
+	ah316[5] = coolFlag
+	binary.BigEndian.PutUint16(ah316[7:9], cfm)
+	binary.BigEndian.PutUint16(ah316[10:12], uint16(sp*65536))
+
+	// table 3e01: outside and coil temps x16
+	hp301 := []byte{0x00, 0x3e, 0x01, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(hp301[3:5], uint16(int16(math.Round(t.outdoor*16))))
+	binary.BigEndian.PutUint16(hp301[5:7], uint16(int16(math.Round(t.coilTemp*16))))
+
+	// table 3e02: compressor stage
+	coolStage := uint8(0)
+	if t.cooling {
+		coolStage = t.stage
+	}
+	hp302 := []byte{0x00, 0x3e, 0x02, coolStage << 1, 0x00}
+
+	// table 0319: damper positions 0-15, first 4 zones only
+	dp := []byte{0x00, 0x03, 0x19, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	for zi := 0; zi < 4; zi++ {
+		if t.temps[zi] == 0 {
+			continue
+		}
+		dp[3+zi] = 15
+		if running && t.demand[zi] == 0 {
+			dp[3+zi] = 2
+		}
+	}
+
+	var frames []*InfinityFrame
+	poll := func(dev uint16, data []byte) {
+		frames = append(frames,
+			&InfinityFrame{src: devTSTAT, dst: dev, op: opREAD, data: data[0:3]},
+			&InfinityFrame{src: dev, dst: devTSTAT, op: opRESPONSE, data: data})
+	}
+	poll(simAirHandler, ah306)
+	poll(simAirHandler, ah316)
+	poll(simHeatPump, hp301)
+	poll(simHeatPump, hp302)
+	poll(simDampers, dp)
+
+	// the thermostat's broadcast of outdoor temp and humidity
+	bc := []byte{0x00, 0x04, 0x20, 0xc0, 0x02, 0xc0, 0x00, 0x0f, 0x01, 0, 0, 0x01, 0x02, t.actuals.Humidity, 0x3c, 0x50, 0x00, 0x40, 0x56, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(bc[9:11], uint16(t.actuals.OutdoorTemp))
+	frames = append(frames, &InfinityFrame{src: devTSTAT, dst: 0xf1f1, op: opWRITE, data: bc})
+
+	// and the program period and setpoints sent to each smart sensor
+	period := t.period(time.Now())
+	for zi := 1; zi < 8; zi++ {
+		if t.temps[zi] == 0 {
+			continue
+		}
+		heatSP, coolSP := t.setpoints(zi)
+		ss := []byte{0x00, 0x04, 0x1f, 0x10, period, 0, 0, 0, 0, uint8(heatSP), uint8(coolSP), 0, 0, 0x04, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+		frames = append(frames, &InfinityFrame{src: devTSTAT, dst: devTSTAT + uint16(zi)<<8, op: opWRITE, data: ss})
+	}
+
+	return frames
+}
+
+// the schedule period in effect at a given time, per zone 1's program
+func (t *simTransport) period(now time.Time) uint8 {
+	mins := uint16(now.Hour()*60 + now.Minute())
+	// before the first period of the day it's still last night's sleep
+	period := uint8(len(schedulePeriods) - 1)
+	for pi, p := range t.schedule[now.Weekday()].Zones[0] {
+		if p.StartTime <= mins {
+			period = uint8(pi)
+		}
+	}
+	return period
+}
+
+// the thermostat table for an address, or nil if we don't simulate it
+func (t *simTransport) table(addr []byte) interface{} {
+	var a InfinityTableAddr
+	copy(a[:], addr)
+
+	switch a {
+	case t.current.addr():
+		return &t.current
+	case t.zone.addr():
+		return &t.zone
+	case t.vacation.addr():
+		return &t.vacation
+	case t.settings.addr():
+		return &t.settings
+	case t.temps16.addr():
+		return &t.temps16
+	case t.actuals.addr():
+		return &t.actuals
+	}
+	for day := range t.schedule {
+		if a == scheduleTableAddr(day) {
+			return &t.schedule[day]
+		}
+	}
+	return nil
+}
+
+// the 01.04 identification of a simulated device; the damper controller
+// doesn't give one
+func simDeviceInfo(dev uint16) *DeviceInfo {
+	ids := map[uint16][4]string{
+		devTSTAT:      { "SYSTEM TSTAT", "CESR131329-04", "SYSTXCCITC01-A", "1234W000001" },
+		simAirHandler: { "FURNACE", "CESR131338-02", "59TN6A060V17", "2214A000002" },
+		simHeatPump:   { "AC 2 STAGE", "CESR131376-03", "24ANB736A003", "3715E000003" },
+	}
+	id, ok := ids[dev]
+	if !ok {
+		return nil
+	}
+
+	info := &DeviceInfo{}
+	copy(info.ModuleName[:], id[0])
+	copy(info.FirmwareVersion[:], id[1])
+	copy(info.ModelNumber[:], id[2])
+	copy(info.SerialNumber[:], id[3])
+	return info
+}
+
+// frames we send go to the simulated thermostat
+func (t *simTransport) Write(b []byte) (int, error) {
+	req := &InfinityFrame{}
+	if len(b) < 10 || !req.decode(b) || len(req.data) < 3 {
+		return len(b), nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	res := &InfinityFrame{src: req.dst, dst: req.src, op: opRESPONSE}
+
+	switch req.op {
+	case opREAD:
+		// header is the table address followed by 3 bytes we leave zero;
+		// tables we don't simulate get just the header
+		var buf bytes.Buffer
+		buf.Write(req.data[0:3])
+		buf.Write([]byte{0x00, 0x00, 0x00})
+		if req.dst == devTSTAT {
+			if tbl := t.table(req.data[0:3]); tbl != nil {
+				binary.Write(&buf, binary.BigEndian, tbl)
+			}
+		}
+		if info := simDeviceInfo(req.dst); info != nil && bytes.Equal(req.data[0:3], []byte{0x00, 0x01, 0x04}) {
+			binary.Write(&buf, binary.BigEndian, info)
+		}
+		res.data = buf.Bytes()
+	case opWRITE:
+		res.data = []byte{0x00}
+		if req.dst == devTSTAT && len(req.data) > 6 {
+			if tbl := t.table(req.data[0:3]); tbl != nil {
+				zone := int(req.data[3])
+				mask := uint16(req.data[4])<<8 | uint16(req.data[5])
+				// there are 8 zones at most; NAK a write to any other
+				if zone >= 8 {
+					log.Warnf("sim: bad write %s: no zone %d", req, zone)
+					res.op = opERROR
+					break
+				}
+				if err := t.applyWrite(tbl, zone, mask, req.data[6:]); err != nil {
+					log.Warnf("sim: bad write %s: %s", req, err)
+				}
+			}
+		}
+	default:
+		return len(b), nil
+	}
+
+	t.reply(res)
+	return len(b), nil
+}
+
+// apply a flag-addressed table write the way the thermostat does: only the
+// flagged fields change, and in the zone table only the addressed zone's
+// element of each per-zone array (or bit of a per-zone bit mask)
+func (t *simTransport) applyWrite(tbl interface{}, zone int, mask uint16, data []byte) error {
+	cur := reflect.ValueOf(tbl).Elem()
+	upd := reflect.New(cur.Type())
+	if err := binary.Read(bytes.NewReader(data), binary.BigEndian, upd.Interface()); err != nil {
+		return err
+	}
+	upd = upd.Elem()
+
+	zoned := cur.Type() == reflect.TypeOf(TStatZoneParams{})
+
+	for _, i := range flaggedFields(cur.Type(), mask) {
+		cf := cur.Field(i)
+		uf := upd.Field(i)
+		switch {
+		case !zoned:
+			cf.Set(uf)
+		case cf.Kind() == reflect.Array:
+			cf.Index(zone).Set(uf.Index(zone))
+		case cf.Kind() == reflect.Uint8:
+			zbit := uint64(1) << zone
+			cf.SetUint(cf.Uint()&^zbit | uf.Uint()&zbit)
+		default:
+			cf.Set(uf)
+		}
+	}
+
+	return nil
+}
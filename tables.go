@@ -1,17 +1,86 @@
 package main
 
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
 type InfinityTableAddr [3]byte
 type InfinityTable interface {
 	addr() InfinityTableAddr
 }
 
+// Writes carry a 16-bit flag set saying which fields of the table to
+// update, one bit per field.  Fields are numbered in struct order, except
+// that an `infinity:"field=N"` tag sets the number of a field (and the ones
+// after it carry on from there), for where one field on the bus is split
+// into several struct fields.
+
+// value of key in a field's infinity tag, eg `infinity:"field=4"`, or ""
+// for a key without one, eg `infinity:"writable"`
+func tagValue(sf reflect.StructField, key string) (string, bool) {
+	for _, kv := range strings.Split(sf.Tag.Get("infinity"), ",") {
+		if k, v, _ := strings.Cut(kv, "="); k == key {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// the field number of each struct field of a table type
+func tableFieldNumbers(t reflect.Type) []int {
+	nums := make([]int, t.NumField())
+	n := -1
+	for i := range nums {
+		n++
+		if v, ok := tagValue(t.Field(i), "field"); ok {
+			fn, err := strconv.Atoi(v)
+			if err != nil {
+				panic(fmt.Sprintf("bad field tag on %s.%s", t.Name(), t.Field(i).Name))
+			}
+			n = fn
+		}
+		nums[i] = n
+	}
+	return nums
+}
+
+// write flags for the named fields of a table (or pointer to one); the
+// names are fixed in the code so an unknown one is a bug
+func fieldFlags(table interface{}, names ...string) uint16 {
+	t := reflect.Indirect(reflect.ValueOf(table)).Type()
+	nums := tableFieldNumbers(t)
+	flags := uint16(0)
+	for _, name := range names {
+		sf, ok := t.FieldByName(name)
+		if !ok || nums[sf.Index[0]] > 15 {
+			panic(fmt.Sprintf("no writable field %s in %s", name, t.Name()))
+		}
+		flags |= 1 << nums[sf.Index[0]]
+	}
+	return flags
+}
+
+// indexes of the struct fields of a table type selected by write flags
+func flaggedFields(t reflect.Type, flags uint16) []int {
+	fields := []int{}
+	for i, n := range tableFieldNumbers(t) {
+		if n < 16 && flags & (1 << n) != 0 {
+			fields = append(fields, i)
+		}
+	}
+	return fields
+}
+
 type TStatCurrentParams struct {
-	ZCurrentTemp      [8]uint8
-	ZCurrentHumidity  [8]uint8
+	ZCurrentTemp      [8]uint8 `infinity:"name=currentTemp,units=temp"`
+	ZCurrentHumidity  [8]uint8 `infinity:"name=currentHumidity"`
 	Unknown1          uint8
-	OutdoorAirTemp    uint8
+	OutdoorAirTemp    uint8 `infinity:"field=2,name=outdoorTemp,units=temp"` // written together with Unknown1
 	ZoneUnocc         uint8 // bitflags
-	Mode              uint8
+	Mode              uint8 `infinity:"field=4,name=mode,enum=mode,writable"`
 	Unknown2          [5]uint8
 	DisplayedZone     uint8
 }
@@ -21,15 +90,15 @@ func (params TStatCurrentParams) addr() InfinityTableAddr {
 }
 
 type TStatZoneParams struct {
-	ZFanMode         [8]uint8
-	ZoneHold         uint8 // bitflags
-	ZHeatSetpoint    [8]uint8
-	ZCoolSetpoint    [8]uint8
-	ZTargetHumidity  [8]uint8
+	ZFanMode         [8]uint8 `infinity:"name=fanMode,enum=fanMode,writable"`
+	ZoneHold         uint8    `infinity:"name=hold,bits,writable"`
+	ZHeatSetpoint    [8]uint8 `infinity:"name=heatSetpoint,units=temp,min=40,max=90,writable"`
+	ZCoolSetpoint    [8]uint8 `infinity:"name=coolSetpoint,units=temp,min=50,max=99,writable"`
+	ZTargetHumidity  [8]uint8 `infinity:"name=targetHumidity"`
 	FanAutoCfg       uint8
 	Unknown          uint8
-	ZOvrdDuration    [8]uint16
-	ZName            [8][12]byte
+	ZOvrdDuration    [8]uint16 `infinity:"name=overrideDurationMins,max=1440,writable"`
+	ZName            [8][12]byte `infinity:"name=zoneName"`
 }
 
 func (params TStatZoneParams) addr() InfinityTableAddr {
@@ -50,14 +119,16 @@ func (params DamperParams) addr() InfinityTableAddr {
 	return InfinityTableAddr{0x00, 0x03, 0x19}
 }
 
+// vacation temperature limits are used as heat and cool setpoints, so
+// they're held to the same ranges as the setpoints
 type TStatVacationParams struct {
-	Active         uint8
-	Hours          uint16
-	MinTemperature uint8
-	MaxTemperature uint8
-	MinHumidity    uint8
-	MaxHumidity    uint8
-	FanMode        uint8 // matches fan mode from TStatZoneParams
+	Active         uint8  `infinity:"name=active,bool,writable"`
+	Hours          uint16 `infinity:"name=hours,writable"`
+	MinTemperature uint8  `infinity:"name=minTemperature,units=temp,min=40,max=90,writable"`
+	MaxTemperature uint8  `infinity:"name=maxTemperature,units=temp,min=50,max=99,writable"`
+	MinHumidity    uint8  `infinity:"name=minHumidity,max=100,writable"`
+	MaxHumidity    uint8  `infinity:"name=maxHumidity,max=100,writable"`
+	FanMode        uint8  `infinity:"name=fanMode,enum=fanMode,writable"` // matches fan mode from TStatZoneParams
 }
 
 func (params TStatVacationParams) addr() InfinityTableAddr {
@@ -68,97 +139,273 @@ type APIVacationConfig struct {
 	Active         *bool   `json:"active"`
 	Days           *uint8  `json:"days"`
 	Hours          *uint16 `json:"hours"`
-	MinTemperature *uint8  `json:"minTemperature"`
-	MaxTemperature *uint8  `json:"maxTemperature"`
+	MinTemperature *float32 `json:"minTemperature"`
+	MaxTemperature *float32 `json:"maxTemperature"`
 	MinHumidity    *uint8  `json:"minHumidity"`
 	MaxHumidity    *uint8  `json:"maxHumidity"`
 	FanMode        *string `json:"fanMode"`
 }
 
 func (params TStatVacationParams) toAPI() APIVacationConfig {
-	api := APIVacationConfig{Hours: &params.Hours,
-		MinTemperature: &params.MinTemperature,
-		MaxTemperature: &params.MaxTemperature,
-		MinHumidity:    &params.MinHumidity,
-		MaxHumidity:    &params.MaxHumidity}
-
-	active := bool(params.Active == 1)
-	api.Active = &active
-
-	days := uint8((params.Hours + 23) / 24)
-	api.Days = &days
+	v := decodeFields(&params, 0)
 
-	mode := rawFanModeToString(params.FanMode)
-	api.FanMode = &mode
+	active := v["active"].(bool)
+	hours := v["hours"].(uint16)
+	days := uint8((hours + 23) / 24)
+	minT := v["minTemperature"].(float32)
+	maxT := v["maxTemperature"].(float32)
+	minH := v["minHumidity"].(uint8)
+	maxH := v["maxHumidity"].(uint8)
+	mode := v["fanMode"].(string)
 
-	return api
+	return APIVacationConfig{Active: &active, Days: &days, Hours: &hours,
+		MinTemperature: &minT, MaxTemperature: &maxT,
+		MinHumidity: &minH, MaxHumidity: &maxH, FanMode: &mode}
 }
 
-func (params *TStatVacationParams) fromAPI(config *APIVacationConfig) byte {
-	flags := byte(0)
+// set the fields given in config; returns the write flags for them
+func (params *TStatVacationParams) fromAPI(config *APIVacationConfig) (uint16, error) {
+	values := map[string]interface{}{}
 
-	if config.Active != nil {
-		params.Active = 0
-		if *config.Active == true {
-			params.Active = 1
-		}
-		flags |= 0x01
+	if config.Days != nil && config.Hours != nil {
+		return 0, fmt.Errorf("only one of days and hours may be given")
 	}
+	timeGiven := config.Days != nil || config.Hours != nil
 
+	hours := params.Hours
 	if config.Hours != nil {
-		params.Hours = *config.Hours
-		flags |= 0x02
+		hours = *config.Hours
 	}
 
 	if config.Days != nil {
-		params.Hours = uint16(*config.Days) * uint16(24)
-		flags |= 0x02
+		hours = uint16(*config.Days) * uint16(24)
 	}
 
-	if config.MinTemperature != nil {
-		params.MinTemperature = *config.MinTemperature
-		flags |= 0x04
+	// a duration starts vacation mode, or cancels it if zero; active
+	// does the same explicitly, with cancelling clearing the time left
+	if config.Active != nil {
+		if *config.Active {
+			if timeGiven && hours == 0 {
+				return 0, fmt.Errorf("vacation can't be started with no time")
+			}
+		} else {
+			if hours != 0 {
+				return 0, fmt.Errorf("vacation can't be cancelled with time left")
+			}
+			timeGiven = true
+		}
+		values["active"] = *config.Active
+	} else if timeGiven {
+		values["active"] = hours > 0
 	}
 
-	if config.MaxTemperature != nil {
-		params.MaxTemperature = *config.MaxTemperature
-		flags |= 0x08
+	if timeGiven {
+		values["hours"] = float64(hours)
 	}
 
+	if config.MinTemperature != nil {
+		values["minTemperature"] = float64(*config.MinTemperature)
+	}
+	if config.MaxTemperature != nil {
+		values["maxTemperature"] = float64(*config.MaxTemperature)
+	}
 	if config.MinHumidity != nil {
-		params.MinHumidity = *config.MinHumidity
-		flags |= 0x10
+		values["minHumidity"] = float64(*config.MinHumidity)
 	}
-
 	if config.MaxHumidity != nil {
-		params.MaxHumidity = *config.MaxHumidity
-		flags |= 0x20
+		values["maxHumidity"] = float64(*config.MaxHumidity)
 	}
-
 	if config.FanMode != nil {
-		mode, _ := stringFanModeToRaw(*config.FanMode)
-		// FIXME: check for ok here
-		params.FanMode = mode
-		flags |= 0x40
+		values["fanMode"] = *config.FanMode
 	}
 
-	return flags
+	flags, err := encodeFields(params, 0, values)
+	if err != nil {
+		return 0, err
+	}
+
+	if config.MinTemperature != nil && config.MaxTemperature != nil && params.MaxTemperature < params.MinTemperature {
+		return 0, fmt.Errorf("maximum temperature is below minimum temperature")
+	}
+	if config.MinHumidity != nil && config.MaxHumidity != nil && params.MaxHumidity < params.MinHumidity {
+		return 0, fmt.Errorf("maximum humidity is below minimum humidity")
+	}
+
+	return flags, nil
 }
 
 type TStatSettings struct {
-	BacklightSetting uint8
-	AutoMode         uint8
-	Unknown1         uint8
-	DeadBand         uint8
-	CyclesPerHour    uint8
-	SchedulePeriods  uint8
-	ProgramsEnabled  uint8
-	TempUnits        uint8
+	BacklightSetting uint8    `infinity:"name=backlight,max=10,writable"`
+	AutoMode         uint8    `infinity:"name=autoMode,bool,writable"`
+	Unknown1         uint8    // perhaps reminder flags, see checkReminders
+	DeadBand         uint8    `infinity:"name=deadband,min=2,max=6,writable"`
+	CyclesPerHour    uint8    `infinity:"name=cyclesPerHour,min=2,max=6,writable"`
+	SchedulePeriods  uint8    `infinity:"name=schedulePeriods"`
+	ProgramsEnabled  uint8    `infinity:"name=programsEnabled,bool"`
+	TempUnits        uint8    `infinity:"name=tempUnits,enum=tempUnits,writable"`
 	Unknown2         uint8
-	DealerName       [20]byte
-	DealerPhone      [20]byte
+	DealerName       [20]byte `infinity:"name=dealerName"`
+	DealerPhone      [20]byte `infinity:"name=dealerPhone"`
 }
 
 func (params TStatSettings) addr() InfinityTableAddr {
 	return InfinityTableAddr{0x00, 0x3B, 0x06}
 }
+
+// One period of a daily schedule; the whole table is always written, so
+// the fields are writable only to let them be encoded
+type TStatSchedulePeriod struct {
+	StartTime    uint16 `infinity:"name=startMins,max=1439,writable"` // minutes past midnight
+	HeatSetpoint uint8  `infinity:"name=heatSetpoint,units=temp,min=40,max=90,writable"`
+	CoolSetpoint uint8  `infinity:"name=coolSetpoint,units=temp,min=50,max=99,writable"`
+	FanMode      uint8  `infinity:"name=fanMode,enum=fanMode,writable"` // 0xff when the period doesn't set the fan mode
+}
+
+// Daily schedule for all zones, 4 periods (wake, day, evening, sleep) each.
+// There is one of these tables per day of the week, 3b07 (Sunday) through
+// 3b0d (Saturday), so the address is not fixed; use scheduleTableAddr().
+type TStatDaySchedule struct {
+	Zones [8][4]TStatSchedulePeriod
+}
+
+var scheduleDays = [7]string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"}
+var schedulePeriods = [4]string{"wake", "day", "evening", "sleep"}
+
+func scheduleTableAddr(day int) InfinityTableAddr {
+	return InfinityTableAddr{0x00, 0x3B, byte(0x07 + day)}
+}
+
+type APISchedulePeriod struct {
+	Period       string `json:"period"`
+	StartTime    string `json:"startTime"`
+	StartMins    uint16 `json:"startMins"`
+	HeatSetpoint float32 `json:"heatSetpoint"`
+	CoolSetpoint float32 `json:"coolSetpoint"`
+	FanMode      string `json:"fanMode,omitempty"`
+}
+
+// a zone's schedule for the week, keyed by day name
+type APIZoneSchedule struct {
+	ZoneNumber uint8                           `json:"zoneNumber"`
+	Days       map[string][]APISchedulePeriod `json:"days"`
+}
+
+type APISchedule struct {
+	Zones []APIZoneSchedule `json:"zones"`
+}
+
+func (params TStatDaySchedule) toAPI(zi int) []APISchedulePeriod {
+	periods := make([]APISchedulePeriod, len(schedulePeriods))
+
+	for pi := range params.Zones[zi] {
+		p := &params.Zones[zi][pi]
+		v := decodeFields(p, 0)
+		periods[pi] = APISchedulePeriod{
+			Period:       schedulePeriods[pi],
+			StartTime:    fmt.Sprintf("%d:%02d", p.StartTime/60, p.StartTime%60),
+			StartMins:    v["startMins"].(uint16),
+			HeatSetpoint: v["heatSetpoint"].(float32),
+			CoolSetpoint: v["coolSetpoint"].(float32),
+		}
+		if p.FanMode != 0xff {
+			periods[pi].FanMode = v["fanMode"].(string)
+		}
+	}
+
+	return periods
+}
+
+// update one zone's periods from the API form; startTime ("H:MM") takes
+// precedence over startMins if both are given
+func (params *TStatDaySchedule) fromAPI(zi int, periods []APISchedulePeriod) error {
+	if len(periods) != len(schedulePeriods) {
+		return fmt.Errorf("schedule must have %d periods, got %d", len(schedulePeriods), len(periods))
+	}
+
+	var last uint16
+	for pi, ap := range periods {
+		start := ap.StartMins
+		if len(ap.StartTime) > 0 {
+			var h, m uint16
+			if n, err := fmt.Sscanf(ap.StartTime, "%d:%d", &h, &m); err != nil || n != 2 || m > 59 {
+				return fmt.Errorf("invalid start time '%s' for period %d", ap.StartTime, pi+1)
+			}
+			start = h*60 + m
+		}
+		if start >= 24*60 {
+			return fmt.Errorf("start time for period %d is past midnight", pi+1)
+		}
+		if pi > 0 && start < last {
+			return fmt.Errorf("start time for period %d is before period %d", pi+1, pi)
+		}
+		last = start
+
+		values := map[string]interface{}{
+			"startMins":    float64(start),
+			"heatSetpoint": float64(ap.HeatSetpoint),
+			"coolSetpoint": float64(ap.CoolSetpoint),
+		}
+		if len(ap.FanMode) > 0 {
+			values["fanMode"] = ap.FanMode
+		}
+
+		p := TStatSchedulePeriod{FanMode: 0xff}
+		if _, err := encodeFields(&p, 0, values); err != nil {
+			return fmt.Errorf("period %d: %s", pi+1, err)
+		}
+		if p.CoolSetpoint < p.HeatSetpoint {
+			return fmt.Errorf("cool setpoint below heat setpoint for period %d", pi+1)
+		}
+
+		params.Zones[zi][pi] = p
+	}
+
+	return nil
+}
+
+// One zone's temperature sensor in table 3d02
+type TStatZoneSensor struct {
+	Flags   uint16 `infinity:"name=sensorType,enum=sensorType"` // low byte seems to give the kind of sensor, 0 if none
+	RawTemp int16  `infinity:"name=currentTempPrecise,units=temp,scale=16"`
+	Temp    uint8  // smoothed temp for display, as in TStatCurrentParams
+}
+
+// High-resolution zone temperatures
+type TStatZoneTemps struct {
+	Unknown uint8
+	Zones   [8]TStatZoneSensor
+}
+
+func (params TStatZoneTemps) addr() InfinityTableAddr {
+	return InfinityTableAddr{0x00, 0x3D, 0x02}
+}
+
+// Current outdoor temp and indoor humidity, at better resolution than
+// TStatCurrentParams and with the outdoor temp signed
+type TStatActuals struct {
+	Unknown1    [2]uint8
+	OutdoorTemp int16 `infinity:"name=outdoorTempPrecise,units=temp,scale=16"`
+	Unknown2    uint16
+	Humidity    uint8 // smoothed, as in TStatCurrentParams
+	Unknown3    uint8
+	RawHumidity uint8 `infinity:"name=rawHumidity"`
+	Unknown4    [6]uint8
+}
+
+func (params TStatActuals) addr() InfinityTableAddr {
+	return InfinityTableAddr{0x00, 0x3D, 0x03}
+}
+
+// Device identification, which each device seems to answer for itself;
+// the layout is as reported for thermostats and may be shorter on some
+// equipment, so it's read raw and zero-filled (see probeDevice)
+type DeviceInfo struct {
+	ModuleName      [48]byte `infinity:"name=moduleName"`
+	FirmwareVersion [16]byte `infinity:"name=firmwareVersion"`
+	ModelNumber     [20]byte `infinity:"name=modelNumber"`
+	SerialNumber    [36]byte `infinity:"name=serialNumber"`
+}
+
+func (params DeviceInfo) addr() InfinityTableAddr {
+	return InfinityTableAddr{0x00, 0x01, 0x04}
+}
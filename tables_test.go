@@ -0,0 +1,131 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestVacationFromAPI(t *testing.T) {
+	b := func(v bool) *bool { return &v }
+	u8 := func(v uint8) *uint8 { return &v }
+	u16 := func(v uint16) *uint16 { return &v }
+	f32 := func(v float32) *float32 { return &v }
+	s := func(v string) *string { return &v }
+
+	active := fieldFlags(TStatVacationParams{}, "Active")
+	hours := fieldFlags(TStatVacationParams{}, "Hours")
+
+	tests := []struct {
+		name   string
+		config APIVacationConfig
+		flags  uint16
+		want   TStatVacationParams	// the fields flagged
+		err    bool
+	}{
+		{"days start it", APIVacationConfig{Days: u8(2)}, active | hours,
+			TStatVacationParams{Active: 1, Hours: 48}, false},
+		{"hours start it", APIVacationConfig{Hours: u16(5)}, active | hours,
+			TStatVacationParams{Active: 1, Hours: 5}, false},
+		{"zero cancels it", APIVacationConfig{Days: u8(0)}, active | hours,
+			TStatVacationParams{}, false},
+		{"days and hours", APIVacationConfig{Days: u8(1), Hours: u16(3)}, 0, TStatVacationParams{}, true},
+		{"active with time", APIVacationConfig{Active: b(true), Hours: u16(12)}, active | hours,
+			TStatVacationParams{Active: 1, Hours: 12}, false},
+		{"active alone", APIVacationConfig{Active: b(true)}, active,
+			TStatVacationParams{Active: 1}, false},
+		{"active with no time", APIVacationConfig{Active: b(true), Hours: u16(0)}, 0, TStatVacationParams{}, true},
+		{"cancel clears time", APIVacationConfig{Active: b(false)}, active | hours,
+			TStatVacationParams{}, false},
+		{"cancel with time", APIVacationConfig{Active: b(false), Days: u8(1)}, 0, TStatVacationParams{}, true},
+		{"limits", APIVacationConfig{MinTemperature: f32(55), MaxTemperature: f32(85), MinHumidity: u8(20), MaxHumidity: u8(60)},
+			fieldFlags(TStatVacationParams{}, "MinTemperature", "MaxTemperature", "MinHumidity", "MaxHumidity"),
+			TStatVacationParams{MinTemperature: 55, MaxTemperature: 85, MinHumidity: 20, MaxHumidity: 60}, false},
+		{"min temp out of range", APIVacationConfig{MinTemperature: f32(35)}, 0, TStatVacationParams{}, true},
+		{"max temp out of range", APIVacationConfig{MaxTemperature: f32(100)}, 0, TStatVacationParams{}, true},
+		{"temps crossed", APIVacationConfig{MinTemperature: f32(80), MaxTemperature: f32(70)}, 0, TStatVacationParams{}, true},
+		{"humidity out of range", APIVacationConfig{MaxHumidity: u8(101)}, 0, TStatVacationParams{}, true},
+		{"humidity crossed", APIVacationConfig{MinHumidity: u8(60), MaxHumidity: u8(40)}, 0, TStatVacationParams{}, true},
+		{"fan mode", APIVacationConfig{FanMode: s("high")}, fieldFlags(TStatVacationParams{}, "FanMode"),
+			TStatVacationParams{FanMode: 3}, false},
+		{"bad fan mode", APIVacationConfig{FanMode: s("turbo")}, 0, TStatVacationParams{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := TStatVacationParams{}
+			flags, err := params.fromAPI(&tt.config)
+			if (err != nil) != tt.err {
+				t.Fatalf("err = %v, want error %v", err, tt.err)
+			}
+			if flags != tt.flags {
+				t.Errorf("flags = 0x%04x, want 0x%04x", flags, tt.flags)
+			}
+			if !tt.err && params != tt.want {
+				t.Errorf("got %+v, want %+v", params, tt.want)
+			}
+		})
+	}
+}
+
+func TestDayScheduleFromAPI(t *testing.T) {
+	period := func(start string, heat, cool float32, fan string) APISchedulePeriod {
+		return APISchedulePeriod{StartTime: start, HeatSetpoint: heat, CoolSetpoint: cool, FanMode: fan}
+	}
+	day := []APISchedulePeriod{
+		period("6:30", 68, 76, ""),
+		period("8:00", 62, 80, "auto"),
+		period("17:00", 68, 76, ""),
+		period("22:00", 64, 78, "high"),
+	}
+	with := func(pi int, p APISchedulePeriod) []APISchedulePeriod {
+		d := append([]APISchedulePeriod{}, day...)
+		d[pi] = p
+		return d
+	}
+
+	tests := []struct {
+		name    string
+		periods []APISchedulePeriod
+		want    [4]TStatSchedulePeriod
+		err     bool
+	}{
+		{"day", day, [4]TStatSchedulePeriod{
+			{390, 68, 76, 0xff}, {480, 62, 80, 0}, {1020, 68, 76, 0xff}, {1320, 64, 78, 3}}, false},
+		{"start mins", with(0, APISchedulePeriod{StartMins: 300, HeatSetpoint: 66, CoolSetpoint: 77}), [4]TStatSchedulePeriod{
+			{300, 66, 77, 0xff}, {480, 62, 80, 0}, {1020, 68, 76, 0xff}, {1320, 64, 78, 3}}, false},
+		{"too few periods", day[:3], [4]TStatSchedulePeriod{}, true},
+		{"bad start time", with(1, period("8:60", 62, 80, "")), [4]TStatSchedulePeriod{}, true},
+		{"past midnight", with(3, period("24:00", 64, 78, "")), [4]TStatSchedulePeriod{}, true},
+		{"out of order", with(2, period("7:00", 68, 76, "")), [4]TStatSchedulePeriod{}, true},
+		{"heat below min", with(0, period("6:30", 35, 76, "")), [4]TStatSchedulePeriod{}, true},
+		{"cool above max", with(0, period("6:30", 68, 100, "")), [4]TStatSchedulePeriod{}, true},
+		{"crossed setpoints", with(0, period("6:30", 78, 70, "")), [4]TStatSchedulePeriod{}, true},
+		{"bad fan mode", with(0, period("6:30", 68, 76, "turbo")), [4]TStatSchedulePeriod{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sched := TStatDaySchedule{}
+			err := sched.fromAPI(1, tt.periods)
+			if (err != nil) != tt.err {
+				t.Fatalf("err = %v, want error %v", err, tt.err)
+			}
+			if tt.err {
+				return
+			}
+			if sched.Zones[1] != tt.want {
+				t.Errorf("got %v, want %v", sched.Zones[1], tt.want)
+			}
+			if sched.Zones[0] != ([4]TStatSchedulePeriod{}) {
+				t.Errorf("zone 1 changed: %v", sched.Zones[0])
+			}
+
+			// and back again
+			for pi, p := range sched.toAPI(1) {
+				if p.StartMins != tt.want[pi].StartTime || p.HeatSetpoint != float32(tt.want[pi].HeatSetpoint) ||
+					(p.FanMode == "") != (tt.want[pi].FanMode == 0xff) {
+					t.Errorf("period %d toAPI: %+v", pi+1, p)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tarm/serial"
+)
+
+// A bus transport carries raw ABCD bus bytes to and from infinitive.  Read
+// must not block forever: if nothing arrives within readTimeout it should
+// return zero bytes or an error so the reader can reopen the transport.
+type InfinityTransport interface {
+	io.ReadWriteCloser
+}
+
+// open the transport described by dev, which is either a plain device path
+// ("/dev/ttyUSB0") or a URL selecting the transport type:
+//	serial:///dev/ttyUSB0	local serial device
+//	tcp://host:port		raw TCP serial bridge (ser2net "raw" mode and similar)
+//	rfc2217://host:port	telnet serial bridge with RFC2217 port control
+//	replay:///path/to/log	play back a resplog file (see replay.go)
+//	sim://			built-in simulated system (see simulator.go)
+func openTransport(dev string) (InfinityTransport, error) {
+	u, err := url.Parse(dev)
+	if err != nil || u.Scheme == "" || len(u.Scheme) == 1 {
+		// not a URL (or a windows drive letter): treat as a device path
+		return openSerialTransport(dev)
+	}
+
+	switch u.Scheme {
+	case "serial":
+		return openSerialTransport(u.Path)
+	case "tcp":
+		return openTCPTransport(u.Host)
+	case "rfc2217", "telnet":
+		return openRFC2217Transport(u.Host)
+	case "replay":
+		return openReplayTransport(u)
+	case "sim":
+		return openSimTransport(u)
+	default:
+		return nil, fmt.Errorf("unsupported bus transport '%s'", u.Scheme)
+	}
+}
+
+func openSerialTransport(path string) (InfinityTransport, error) {
+	c := &serial.Config{Name: path, Baud: 38400, ReadTimeout: readTimeout}
+	port, err := serial.OpenPort(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return port, nil
+}
+
+// raw TCP transport; bytes are passed through unmodified
+type tcpTransport struct {
+	conn net.Conn
+}
+
+func openTCPTransport(addr string) (InfinityTransport, error) {
+	conn, err := net.DialTimeout("tcp", addr, readTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tcpTransport{conn: conn}, nil
+}
+
+func (t *tcpTransport) Read(b []byte) (int, error) {
+	// mimic the serial read timeout so a silent bridge gets reconnected
+	t.conn.SetReadDeadline(time.Now().Add(readTimeout))
+	return t.conn.Read(b)
+}
+
+func (t *tcpTransport) Write(b []byte) (int, error) {
+	t.conn.SetWriteDeadline(time.Now().Add(readTimeout))
+	return t.conn.Write(b)
+}
+
+func (t *tcpTransport) Close() error {
+	return t.conn.Close()
+}
+
+// frameFeed presents frames built in memory as a byte stream through Read,
+// for the transports that make up bus traffic instead of reading a port
+type frameFeed struct {
+	frames  chan []byte	// bus traffic between other devices
+	replies chan []byte	// answers to our own requests
+	done    chan struct{}
+	pending []byte		// part of a frame not yet returned by Read
+}
+
+func newFrameFeed() *frameFeed {
+	return &frameFeed{
+		frames:  make(chan []byte, 32),
+		replies: make(chan []byte, 32),
+		done:    make(chan struct{}),
+	}
+}
+
+// queue a frame of bus traffic, blocking until the reader takes it;
+// returns false if the transport has been closed
+func (f *frameFeed) send(frame *InfinityFrame) bool {
+	select {
+	case f.frames <- frame.encode():
+		return true
+	case <-f.done:
+		return false
+	}
+}
+
+// queue an answer to one of our own requests; this is called from the
+// goroutines that write to the transport so it must never block
+func (f *frameFeed) reply(frame *InfinityFrame) {
+	select {
+	case f.replies <- frame.encode():
+	default:
+		log.Warn("reply queue full, dropping reply")
+	}
+}
+
+func (f *frameFeed) Read(b []byte) (int, error) {
+	if len(f.pending) == 0 {
+		// answers to our own requests take priority over other traffic
+		select {
+		case f.pending = <-f.replies:
+		default:
+			select {
+			case f.pending = <-f.replies:
+			case f.pending = <-f.frames:
+			case <-f.done:
+				return 0, errors.New("transport closed")
+			}
+		}
+	}
+
+	n := copy(b, f.pending)
+	f.pending = f.pending[n:]
+	return n, nil
+}
+
+func (f *frameFeed) Close() error {
+	select {
+	case <-f.done:
+	default:
+		close(f.done)
+	}
+	return nil
+}
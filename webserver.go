@@ -1,11 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"net/http"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"golang.org/x/net/websocket"
 
@@ -34,6 +39,44 @@ func webserver(port int) {
 		}
 	})
 
+	api.PUT("/tstat/settings", func(c *gin.Context) {
+		var args map[string]interface{}
+
+		if c.BindJSON(&args) != nil {
+			log.Printf("bind failed")
+			return
+		}
+
+		// only the user settings can be written
+		params := TStatSettings{}
+		bad := []string{}
+		for name := range args {
+			if !writableField(params, name) {
+				bad = append(bad, name)
+			}
+		}
+		if len(bad) > 0 {
+			sort.Strings(bad)
+			c.AbortWithError(400, fmt.Errorf("unknown or read-only settings: %s", strings.Join(bad, ", ")))
+			return
+		}
+
+		flags, err := encodeFields(&params, 0, args)
+		if err != nil {
+			c.AbortWithError(400, err)
+			return
+		}
+
+		if flags != 0 && !infinity.WriteTable(devTSTAT, params, flags) {
+			c.AbortWithError(504, errors.New("timed out writing settings"))
+			return
+		}
+
+		if units, ok := args["tempUnits"].(string); ok {
+			updateTempUnits(units)
+		}
+	})
+
 	api.GET("/zones/config", func(c *gin.Context) {
 		cfgZ0, ok := getZonesConfig()
 		if ok {
@@ -98,65 +141,222 @@ func webserver(port int) {
 		}
 
 		params := TStatVacationParams{}
-		flags := params.fromAPI(&args)
-
-		infinity.WriteTable(devTSTAT, params, flags)
+		flags, err := params.fromAPI(&args)
+		if err != nil {
+			c.AbortWithError(400, err)
+			return
+		}
 
+		if flags != 0 && !infinity.WriteTable(devTSTAT, params, flags) {
+			c.AbortWithError(504, errors.New("timed out writing vacation settings"))
+		}
 	})
 
 	api.PUT("/zone/:zn/config", func(c *gin.Context) {
-		var args TStatZoneConfig
+		var args map[string]interface{}
 		zn, err := strconv.Atoi(c.Param("zn"));
 
-		if c.Bind(&args) != nil {
+		if c.BindJSON(&args) != nil {
 			log.Printf("bind failed")
+			return
 		} else if err != nil || zn < 1 || zn > 8 {
-			log.Printf("invalid zone numner")
-		} else {
-			params := TStatZoneParams{}
-			flags := byte(0)
-			zi := zn - 1
+			c.AbortWithError(400, errors.New("invalid zone number"))
+			return
+		}
 
-			if len(args.FanMode) > 0 {
-				mode, ok := stringFanModeToRaw(args.FanMode)
+		params := TStatZoneParams{}
+		zi := zn - 1
 
-				if !ok {
-					log.Printf("invalid fan mode name")
-					return
-				}
-
-				params.ZFanMode[zi] = mode
-				flags |= 0x01
+		// the writable zone fields; read-only ones are ignored so a GET
+		// document can be sent back with changes
+		zargs := map[string]interface{}{}
+		for name, v := range args {
+			if v != nil && writableField(params, name) {
+				zargs[name] = v
 			}
+		}
 
-			if args.Hold != nil {
-				if *args.Hold {
-					params.ZoneHold = 0x01 << zi
-				}
-				flags |= 0x02
+		// H:MM overrides overrideDurationMins
+		if s, _ := args["overrideDuration"].(string); s != "" {
+			mins, ok := parseHoldTime(s)
+			if !ok {
+				c.AbortWithError(400, errors.New("invalid override duration"))
+				return
 			}
+			zargs["overrideDurationMins"] = float64(mins)
+		}
 
-			if args.HeatSetpoint > 0 {
-				params.ZHeatSetpoint[zi] = args.HeatSetpoint
-				flags |= 0x04
+		flags, err := encodeFields(&params, zi, zargs)
+		if err != nil {
+			c.AbortWithError(400, err)
+			return
+		}
+
+		// mode is global, in another table
+		p := TStatCurrentParams{}
+		mflags := uint16(0)
+		if mode, _ := args["mode"].(string); mode != "" {
+			if mflags, err = encodeField(&p, 0, "mode", mode); err != nil {
+				c.AbortWithError(400, err)
+				return
 			}
+		}
 
-			if args.CoolSetpoint > 0 {
-				params.ZCoolSetpoint[zi] = args.CoolSetpoint
-				flags |= 0x08
+		if flags != 0 {
+			log.Printf("calling WriteTableZ with flags: %d, 0x%x", zi, flags)
+			if !infinity.WriteTableZ(devTSTAT, params, uint8(zi), flags) {
+				c.AbortWithError(504, errors.New("timed out writing zone config"))
+				return
 			}
+		}
+
+		if mflags != 0 && !infinity.WriteTable(devTSTAT, p, mflags) {
+			c.AbortWithError(504, errors.New("timed out writing mode"))
+		}
+	})
+
+	api.GET("/zone/:zn/schedule", func(c *gin.Context) {
+		zn, err := strconv.Atoi(c.Param("zn"))
+		if err != nil || zn < 1 || zn > 8 {
+			c.AbortWithError(400, errors.New("invalid zone number"))
+			return
+		}
+
+		sched, ok := getSchedule([]int{zn - 1})
+		if ok {
+			c.JSON(200, sched.Zones[0])
+		} else {
+			c.AbortWithError(504, errors.New("timed out reading schedule"))
+		}
+	})
+
+	api.PUT("/zone/:zn/schedule", func(c *gin.Context) {
+		var args APIZoneSchedule
+		zn, err := strconv.Atoi(c.Param("zn"))
+
+		if err != nil || zn < 1 || zn > 8 {
+			c.AbortWithError(400, errors.New("invalid zone number"))
+			return
+		}
+		if c.Bind(&args) != nil {
+			log.Printf("bind failed")
+			return
+		}
+
+		args.ZoneNumber = uint8(zn)
+		if err := putSchedule(&APISchedule{Zones: []APIZoneSchedule{args}}); err != nil {
+			c.AbortWithError(400, err)
+		}
+	})
+
+	api.GET("/schedule", func(c *gin.Context) {
+		zones, ok := getZonesConfig()
+		if !ok {
+			c.AbortWithError(504, errors.New("timed out reading zones"))
+			return
+		}
 
-			if flags != 0 {
-				log.Printf("calling WriteTableZ with flags: %d, 0x%x", zi, flags)
-				infinity.WriteTableZ(devTSTAT, params, uint8(zi), flags)
+		zis := []int{}
+		for _, z := range zones.Zones {
+			zis = append(zis, int(z.ZoneNumber)-1)
+		}
+
+		sched, ok := getSchedule(zis)
+		if ok {
+			c.JSON(200, sched)
+		} else {
+			c.AbortWithError(504, errors.New("timed out reading schedule"))
+		}
+	})
+
+	api.PUT("/schedule", func(c *gin.Context) {
+		var args APISchedule
+
+		if c.Bind(&args) != nil {
+			log.Printf("bind failed")
+			return
+		}
+
+		if err := putSchedule(&args); err != nil {
+			c.AbortWithError(400, err)
+		}
+	})
+
+	api.GET("/alerts", func(c *gin.Context) {
+		list, history := getAlerts()
+		c.JSON(200, gin.H{"alerts": list, "history": history})
+	})
+
+	api.GET("/diagnostics", func(c *gin.Context) {
+		c.JSON(200, getDiagnostics())
+	})
+
+	api.GET("/bus/stats", func(c *gin.Context) {
+		c.JSON(200, getBusStats())
+	})
+
+	api.GET("/history", func(c *gin.Context) {
+		if history == nil {
+			c.AbortWithError(404, errors.New("no history is being kept"))
+			return
+		}
+
+		keys := []string{}
+		for _, k := range c.QueryArray("key") {
+			for _, key := range strings.Split(k, ",") {
+				if key != "" {
+					keys = append(keys, key)
+				}
 			}
+		}
+		if len(keys) == 0 {
+			c.AbortWithError(400, errors.New("no key given"))
+			return
+		}
+
+		to, err := parseHistoryTime(c.Query("to"), time.Now())
+		if err != nil {
+			c.AbortWithError(400, errors.New("invalid to time"))
+			return
+		}
+		from, err := parseHistoryTime(c.Query("from"), to.Add(-24 * time.Hour))
+		if err != nil || !from.Before(to) {
+			c.AbortWithError(400, errors.New("invalid from time"))
+			return
+		}
 
-			if len(args.Mode) > 0 {
-				m, _ := stringModeToRaw(args.Mode)
-				p := TStatCurrentParams{Mode: m}
-				infinity.WriteTable(devTSTAT, p, 0x10)
+		step := time.Duration(0)
+		if s := c.Query("step"); s != "" {
+			step, err = time.ParseDuration(s)
+			if err != nil || step <= 0 {
+				c.AbortWithError(400, errors.New("invalid step"))
+				return
+			}
+			if to.Sub(from) / step > historyMaxSteps {
+				c.AbortWithError(400, fmt.Errorf("step too small, more than %d steps", historyMaxSteps))
+				return
 			}
 		}
+
+		c.JSON(200, history.query(keys, from, to, step))
+	})
+
+	api.GET("/runtime", func(c *gin.Context) {
+		days, err := strconv.Atoi(c.DefaultQuery("days", "7"))
+		if err != nil || days < 0 || days > runtimeDaysKept {
+			c.AbortWithError(400, fmt.Errorf("days must be 0-%d", runtimeDaysKept))
+			return
+		}
+		weeks, err := strconv.Atoi(c.DefaultQuery("weeks", "4"))
+		if err != nil || weeks < 0 || weeks > runtimeDaysKept / 7 {
+			c.AbortWithError(400, fmt.Errorf("weeks must be 0-%d", runtimeDaysKept / 7))
+			return
+		}
+		c.JSON(200, getRuntime(days, weeks))
+	})
+
+	api.GET("/devices", func(c *gin.Context) {
+		c.JSON(200, getDevices())
 	})
 
 	api.GET("/raw/:device/:table", func(c *gin.Context) {
@@ -194,6 +394,12 @@ func webserver(port int) {
 	r.StaticFS("/ui", assetFS())
 	// r.Static("/ui", "github.com/acd/infinitease/assets")
 
+	r.GET("/metrics", func(c *gin.Context) {
+		var b bytes.Buffer
+		writeMetrics(&b)
+		c.Data(200, "text/plain; version=0.0.4; charset=utf-8", b.Bytes())
+	})
+
 	r.GET("/", func(c *gin.Context) {
 		c.Redirect(http.StatusMovedPermanently, "ui")
 	})